@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/lynic/elsvc"
 )
 
@@ -9,6 +11,6 @@ func main() {
 	err := elsvc.StartService("")
 	if err != nil {
 		elsvc.Error("start go plugin error: %s", err.Error())
-		return
 	}
+	os.Exit(elsvc.ExitCode(err))
 }
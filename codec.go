@@ -0,0 +1,132 @@
+package elsvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var codecMut = &sync.RWMutex{}
+
+// msgType -> struct type of its request payload
+var payloadTypes = make(map[string]reflect.Type)
+
+//RegisterMsgType bind the struct type of v to msgType,
+//request of msgType will be checked against it before delivery
+func RegisterMsgType(msgType string, v interface{}) error {
+	t := structType(v)
+	if t == nil {
+		return fmt.Errorf("payload of %s must be a struct, got %T", msgType, v)
+	}
+	codecMut.Lock()
+	defer codecMut.Unlock()
+	if old, ok := payloadTypes[msgType]; ok && old != t {
+		return fmt.Errorf("msg type %s is registered with %s already", msgType, old)
+	}
+	payloadTypes[msgType] = t
+	return nil
+}
+
+//payloadType returns the registered payload type of msgType
+func payloadType(msgType string) (reflect.Type, bool) {
+	codecMut.RLock()
+	defer codecMut.RUnlock()
+	t, ok := payloadTypes[msgType]
+	return t, ok
+}
+
+//structType returns the struct type of v or pointer to struct
+func structType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+//NewTypedMsg create a msg with v as request, v must be the registered type of msgType
+func NewTypedMsg(msgTo, msgType string, v interface{}) (MsgBase, error) {
+	msg := NewMsg(msgTo, msgType)
+	t, ok := payloadType(msgType)
+	if !ok {
+		return msg, fmt.Errorf("msg type %s is not registered", msgType)
+	}
+	if structType(v) != t {
+		return msg, fmt.Errorf("payload of %s must be %s, got %T", msgType, t, v)
+	}
+	req, err := encodePayload(v)
+	if err != nil {
+		return msg, err
+	}
+	err = msg.SetRequest(req)
+	if err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+//DecodeRequest decode request of msg into v
+func DecodeRequest(msg MsgBase, v interface{}) error {
+	return decodePayload(msg.GetRequest(), v, false)
+}
+
+//DecodeResponse decode response into v, e.g. response returned by Request
+func DecodeResponse(resp map[string]interface{}, v interface{}) error {
+	return decodePayload(resp, v, false)
+}
+
+//SetTypedResponse set v as response of msg
+func SetTypedResponse(msg *MsgBase, v interface{}) error {
+	resp, err := encodePayload(v)
+	if err != nil {
+		return err
+	}
+	return msg.SetResponse(resp)
+}
+
+//validatePayload check request of msg against the registered type of msg
+func validatePayload(msg MsgBase) error {
+	t, ok := payloadType(msg.Type())
+	if !ok {
+		return nil
+	}
+	v := reflect.New(t).Interface()
+	err := decodePayload(msg.MsgRequest, v, true)
+	if err != nil {
+		return NewError(ErrCodeRejected, "payload of %s doesn't match %s: %v", msg.Type(), t, err)
+	}
+	return nil
+}
+
+func encodePayload(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	payload := make(map[string]interface{})
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func decodePayload(payload map[string]interface{}, v interface{}, strict bool) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
@@ -2,8 +2,6 @@ package elsvc
 
 import (
 	"os"
-	"runtime"
-	"time"
 )
 
 // IsDir reports whether the dir exists as a boolean
@@ -25,10 +23,3 @@ func isFile(name string) bool {
 	}
 	return false
 }
-
-func waitGoroutines(num int) {
-	for runtime.NumGoroutine() > num {
-		logger.Debug("wait goruntines: current=%d > expect=%d", runtime.NumGoroutine(), num)
-		time.Sleep(1 * time.Second)
-	}
-}
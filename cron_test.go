@@ -0,0 +1,118 @@
+package elsvc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"x * * * *",
+		"* * * foo *",
+		"@every",
+		"@every 500ms",
+		"@every x",
+		"@weekly extra",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a thursday
+	from := time.Date(2026, 1, 15, 10, 30, 20, 0, time.UTC)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "* * * * *", want: at(1, 15, 10, 31)},
+		{expr: "*/15 * * * *", want: at(1, 15, 10, 45)},
+		{expr: "5/20 * * * *", want: at(1, 15, 10, 45)},
+		{expr: "10,20 * * * *", want: at(1, 15, 11, 10)},
+		{expr: "30 10 * * *", want: at(1, 16, 10, 30)},
+		{expr: "0 9 * * *", want: at(1, 16, 9, 0)},
+		{expr: "0 9-17/4 * * *", want: at(1, 15, 13, 0)},
+		{expr: "0 0 1 * *", want: at(2, 1, 0, 0)},
+		{expr: "0 0 * jun *", want: at(6, 1, 0, 0)},
+		{expr: "0 0 1 JAN-MAR *", want: at(2, 1, 0, 0)},
+		{expr: "0 12 * * mon-fri", want: at(1, 15, 12, 0)},
+		{expr: "0 12 * * sat,sun", want: at(1, 17, 12, 0)},
+		{expr: "0 0 * * 7", want: at(1, 18, 0, 0)},
+		{expr: "0 0 * * 0", want: at(1, 18, 0, 0)},
+		// day matches either dom or dow when both are restricted
+		{expr: "0 0 20 * fri", want: at(1, 16, 0, 0)},
+		{expr: "0 0 16 * mon", want: at(1, 16, 0, 0)},
+		{expr: "0 0 ? * ?", want: at(1, 16, 0, 0)},
+		{expr: "@hourly", want: at(1, 15, 11, 0)},
+		{expr: "@daily", want: at(1, 16, 0, 0)},
+		{expr: "@weekly", want: at(1, 18, 0, 0)},
+		{expr: "@monthly", want: at(2, 1, 0, 0)},
+		{expr: "@yearly", want: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "@every 90s", want: from.Add(90 * time.Second)},
+		{expr: "0 0 29 2 *", want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 30 2 *"},
+		{expr: "0 0 31 4,6,9,11 *"},
+	}
+	for _, tt := range tests {
+		cron, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := cron.next(from); !got.Equal(tt.want) {
+			t.Errorf("next of %q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulePolicy(t *testing.T) {
+	tests := []struct {
+		schedule string
+		overlap  string
+		want     string
+		wantErr  bool
+	}{
+		{schedule: ""},
+		{schedule: "@daily", want: OverlapSkip},
+		{schedule: "*/5 * * * *", overlap: OverlapQueue, want: OverlapQueue},
+		{schedule: "@every 1m", overlap: OverlapAllow, want: OverlapAllow},
+		{schedule: "@daily", overlap: "parallel", wantErr: true},
+		{schedule: "61 * * * *", wantErr: true},
+		{schedule: "0 0 30 2 *", wantErr: true},
+	}
+	for _, tt := range tests {
+		pc := PluginConfig{Schedule: tt.schedule, Overlap: tt.overlap}
+		cron, overlap, err := pc.schedulePolicy()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("schedulePolicy of %q, %q should fail", tt.schedule, tt.overlap)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("schedulePolicy of %q, %q failed: %v", tt.schedule, tt.overlap, err)
+			continue
+		}
+		if (cron == nil) != (tt.schedule == "") || overlap != tt.want {
+			t.Errorf("schedulePolicy of %q, %q = %v, %q, want overlap %q",
+				tt.schedule, tt.overlap, cron, overlap, tt.want)
+		}
+	}
+}
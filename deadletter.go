@@ -0,0 +1,267 @@
+package elsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const defaultDeadLetterSize = 1000
+
+//DeadLetter is a msg dropped by elsvc
+type DeadLetter struct {
+	ID     int64
+	Reason string
+	Origin string // where the msg is dropped, e.g. service, pluginServer.<plugin>
+	Time   time.Time
+	Msg    *MsgBase // nil if the dropped value isn't a valid msg
+	Raw    string   // dropped value printed when Msg is nil
+}
+
+func (s *DeadLetter) view() map[string]interface{} {
+	ret := map[string]interface{}{
+		"id":     s.ID,
+		"reason": s.Reason,
+		"origin": s.Origin,
+		"time":   s.Time.Format(time.RFC3339Nano),
+	}
+	if s.Msg == nil {
+		ret["raw"] = s.Raw
+		return ret
+	}
+	ret["msg"] = msgRecord(*s.Msg)
+	return ret
+}
+
+//deadLetterQueue keeps the latest dropped msgs, the oldest is evicted when full
+type deadLetterQueue struct {
+	letters []*DeadLetter
+	size    int
+	nextID  int64
+	evicted int64
+}
+
+func newDeadLetterQueue(size int) *deadLetterQueue {
+	return &deadLetterQueue{
+		letters: make([]*DeadLetter, 0),
+		size:    size,
+		nextID:  1,
+	}
+}
+
+func (s *deadLetterQueue) add(letter *DeadLetter) {
+	letter.ID = s.nextID
+	s.nextID++
+	if len(s.letters) >= s.size {
+		s.letters = s.letters[1:]
+		s.evicted++
+	}
+	s.letters = append(s.letters, letter)
+}
+
+//restore put a removed letter back with its id
+func (s *deadLetterQueue) restore(letter *DeadLetter) {
+	s.letters = append(s.letters, letter)
+}
+
+//remove deletes letters by ids and returns them, all letters if ids is empty
+func (s *deadLetterQueue) remove(ids []int64) []*DeadLetter {
+	if len(ids) == 0 {
+		removed := s.letters
+		s.letters = make([]*DeadLetter, 0)
+		return removed
+	}
+	idSet := make(map[int64]bool)
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	removed := make([]*DeadLetter, 0)
+	kept := make([]*DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		if idSet[letter.ID] {
+			removed = append(removed, letter)
+			continue
+		}
+		kept = append(kept, letter)
+	}
+	s.letters = kept
+	return removed
+}
+
+//deadLetter record v as dropped at origin
+func (s *Service) deadLetter(v interface{}, origin, reason string) {
+	letter := &DeadLetter{
+		Reason: reason,
+		Origin: origin,
+		Time:   time.Now(),
+	}
+	if msg, ok := v.(MsgBase); ok {
+		letter.Msg = &msg
+	} else {
+		letter.Raw = fmt.Sprintf("%+v", v)
+	}
+	s.deadLetters.add(letter)
+	s.logger.Info("dead letter %d from %s: %s", letter.ID, origin, reason)
+}
+
+//handleDeadLetterMsg handles control msgs of dead letters
+func (s *Service) handleDeadLetterMsg(msg MsgBase) {
+	switch msg.Type() {
+	case MsgDeadLetter:
+		// dropped msg reported by plugin runner or plugin server
+		req := msg.GetRequest()
+		origin, _ := req["origin"].(string)
+		reason, _ := req["reason"].(string)
+		if record, ok := req["msg"].(map[string]interface{}); ok {
+			s.deadLetter(recordMsg(record), origin, reason)
+			return
+		}
+		s.deadLetter(req["raw"], origin, reason)
+	case MsgListDeadLetters:
+		letters := make([]interface{}, 0, len(s.deadLetters.letters))
+		for _, letter := range s.deadLetters.letters {
+			letters = append(letters, letter.view())
+		}
+		msg.SetResponse(map[string]interface{}{
+			"dead_letters": letters,
+			"evicted":      s.deadLetters.evicted,
+		})
+	case MsgPurgeDeadLetters:
+		removed := s.deadLetters.remove(requestIDs(msg.GetRequest()["ids"]))
+		msg.SetResponse(map[string]interface{}{"purged": len(removed)})
+	case MsgRedeliverDeadLetters:
+		removed := s.deadLetters.remove(requestIDs(msg.GetRequest()["ids"]))
+		skipped := make([]int64, 0)
+		redelivered := 0
+		for _, letter := range removed {
+			if letter.Msg == nil {
+				// raw value couldn't be routed
+				skipped = append(skipped, letter.ID)
+				s.deadLetters.restore(letter)
+				continue
+			}
+			rmsg := *letter.Msg
+			rmsg.TTL = defaultMsgTTL
+			rmsg.Deadline = time.Time{}
+			s.logger.Info("redelivering dead letter %d: %+v", letter.ID, rmsg)
+			// checked again like msgs from plugins
+			s.admitMsg(rmsg)
+			redelivered++
+		}
+		msg.SetResponse(map[string]interface{}{
+			"redelivered": redelivered,
+			"skipped":     skipped,
+		})
+	}
+}
+
+//newDeadLetterMsg build a msg reporting v is dropped at origin to service
+func newDeadLetterMsg(v interface{}, origin, reason string) MsgBase {
+	msg := NewMsg(ChanKeyService, MsgDeadLetter)
+	req := map[string]interface{}{
+		"origin": origin,
+		"reason": reason,
+	}
+	if dmsg, ok := v.(MsgBase); ok {
+		msg.inherit(dmsg)
+		req["msg"] = msgRecord(dmsg)
+	} else {
+		req["raw"] = fmt.Sprintf("%+v", v)
+	}
+	msg.SetRequest(req)
+	return msg
+}
+
+//msgRecord returns the serializable fields of msg
+func msgRecord(msg MsgBase) map[string]interface{} {
+	record := map[string]interface{}{
+		"id":          msg.ID(),
+		"correlation": msg.Correlation(),
+		"causation":   msg.Causation(),
+		"from":        msg.From(),
+		"to":          msg.To(),
+		"type":        msg.Type(),
+		"ttl":         msg.TTL,
+		"priority":    msg.Priority,
+	}
+	if len(msg.Headers) != 0 {
+		headers := make(map[string]string, len(msg.Headers))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		record["headers"] = headers
+	}
+	// msg may still be in use by its plugin
+	req := encodedCopy(msg.MsgRequest)
+	request := make(map[string]interface{})
+	if data, err := json.Marshal(req); err == nil && json.Unmarshal(data, &request) == nil {
+		record["request"] = request
+	}
+	return record
+}
+
+//recordMsg rebuild msg from msgRecord
+func recordMsg(record map[string]interface{}) MsgBase {
+	to, _ := record["to"].(string)
+	msgType, _ := record["type"].(string)
+	msg := NewMsg(to, msgType)
+	if id, _ := record["id"].(string); id != "" {
+		msg.MsgId = id
+		msg.CorrelationId, _ = record["correlation"].(string)
+		msg.CausationId, _ = record["causation"].(string)
+	}
+	msg.MsgFrom, _ = record["from"].(string)
+	switch ttl := record["ttl"].(type) {
+	case int64:
+		msg.TTL = ttl
+	case float64:
+		msg.TTL = int64(ttl)
+	}
+	switch priority := record["priority"].(type) {
+	case int:
+		msg.Priority = priority
+	case float64:
+		msg.Priority = int(priority)
+	}
+	switch headers := record["headers"].(type) {
+	case map[string]string:
+		for k, v := range headers {
+			msg.SetHeader(k, v)
+		}
+	case map[string]interface{}:
+		for k, v := range headers {
+			if value, ok := v.(string); ok {
+				msg.SetHeader(k, value)
+			}
+		}
+	}
+	if request, ok := record["request"].(map[string]interface{}); ok {
+		msg.SetRequest(request)
+	}
+	return msg
+}
+
+//requestIDs convert ids in request, it could be decoded from json or not
+func requestIDs(v interface{}) []int64 {
+	ids := make([]int64, 0)
+	switch vs := v.(type) {
+	case []int64:
+		return vs
+	case []int:
+		for _, id := range vs {
+			ids = append(ids, int64(id))
+		}
+	case []interface{}:
+		for _, id := range vs {
+			switch n := id.(type) {
+			case float64:
+				ids = append(ids, int64(n))
+			case int:
+				ids = append(ids, int64(n))
+			case int64:
+				ids = append(ids, n)
+			}
+		}
+	}
+	return ids
+}
@@ -0,0 +1,43 @@
+package elsvc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedeliverDeadLetterIntercepted(t *testing.T) {
+	s := testService(t, "log_level: info\n")
+	msg := NewMsg("echo", "ping")
+	msg.MsgFrom = "client"
+	s.deadLetter(msg, "test", "echo isn't loaded")
+	letter := s.deadLetters.letters[0]
+	err := s.AddInterceptor("guard", 0, func(msg *MsgBase) error {
+		if msg.Type() == "ping" {
+			return NewError(ErrCodeRejected, "ping is blocked")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := NewMsg(ChanKeyService, MsgRedeliverDeadLetters)
+	req.SetRequest(map[string]interface{}{"ids": []int64{letter.ID}})
+	if stop, err := s.handleMsg(req); stop || err != nil {
+		t.Fatalf("handleMsg = %v, %v", stop, err)
+	}
+	if n, _ := req.GetResponse()["redelivered"].(int); n != 1 {
+		t.Errorf("redelivered = %v, want 1", req.GetResponse()["redelivered"])
+	}
+	// rejected by interceptor instead of being routed
+	if len(s.parked) != 0 {
+		t.Errorf("redelivered letter is routed to echo: %+v", s.parked[0].msg)
+	}
+	letters := s.deadLetters.letters
+	if len(letters) != 1 || letters[0].ID == letter.ID || !strings.Contains(letters[0].Reason, "ping is blocked") {
+		t.Fatalf("dead letters = %+v, want the letter rejected by guard", letters)
+	}
+	if letters[0].Msg.ID() != msg.ID() {
+		t.Errorf("dead letter of msg %s, want %s", letters[0].Msg.ID(), msg.ID())
+	}
+}
@@ -0,0 +1,200 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultReadyTimeout = 30 * time.Second
+
+//errServiceStopped is returned if service is stopped by a stop msg during startup
+var errServiceStopped = errors.New("service is stopped")
+
+//sortPlugins returns plugin instances sorted by dependencies, a plugin comes after
+//all plugins it depends on, independent plugins keep the order in configs
+func sortPlugins(configs []PluginConfig) ([]string, error) {
+	deps := make(map[string][]string)
+	names := make([]string, 0, len(configs))
+	for _, pc := range configs {
+		name := pc.InstanceName()
+		if _, ok := deps[name]; ok {
+			return nil, fmt.Errorf("plugin %s is configured more than once", name)
+		}
+		deps[name] = pc.DependsOn
+		names = append(names, name)
+	}
+	// number of dependencies not sorted yet
+	pending := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, name := range names {
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok {
+				return nil, fmt.Errorf("plugin %s depends on %s which isn't configured", name, dep)
+			}
+			pending[name]++
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	done := make(map[string]bool)
+	for len(sorted) < len(names) {
+		next := ""
+		for _, name := range names {
+			if !done[name] && pending[name] == 0 {
+				next = name
+				break
+			}
+		}
+		if next == "" {
+			return nil, fmt.Errorf("dependency cycle: %s", findCycle(names, deps, done))
+		}
+		done[next] = true
+		sorted = append(sorted, next)
+		for _, name := range dependents[next] {
+			pending[name]--
+		}
+	}
+	return sorted, nil
+}
+
+//findCycle returns a dependency cycle among plugins not sorted, e.g. a -> b -> a
+func findCycle(names []string, deps map[string][]string, sorted map[string]bool) string {
+	visiting := make(map[string]int) // plugin -> index in path
+	path := make([]string, 0)
+	var visit func(name string) string
+	visit = func(name string) string {
+		if i, ok := visiting[name]; ok {
+			return strings.Join(append(path[i:], name), " -> ")
+		}
+		visiting[name] = len(path)
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if sorted[dep] {
+				continue
+			}
+			if cycle := visit(dep); cycle != "" {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		delete(visiting, name)
+		return ""
+	}
+	for _, name := range names {
+		if sorted[name] {
+			continue
+		}
+		if cycle := visit(name); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+//checkDepends make sure dependencies of pc are loaded
+func (s *Service) checkDepends(pc PluginConfig) error {
+	for _, dep := range pc.DependsOn {
+		if dep == pc.InstanceName() {
+			return fmt.Errorf("dependency cycle: %s -> %s", dep, dep)
+		}
+		if _, ok := s.Plugins[dep]; !ok {
+			return NewError(ErrCodeNotFound, "plugin %s depends on %s which isn't loaded", pc.InstanceName(), dep)
+		}
+	}
+	return nil
+}
+
+//addToOrder put a loaded plugin into order, before plugins depend on it
+func (s *Service) addToOrder(pluginName string) {
+	for _, name := range s.order {
+		if name == pluginName {
+			return
+		}
+	}
+	dependents := s.dependents(pluginName)
+	for i, name := range s.order {
+		for _, dependent := range dependents {
+			if name == dependent {
+				s.order = append(s.order[:i:i], append([]string{pluginName}, s.order[i:]...)...)
+				return
+			}
+		}
+	}
+	s.order = append(s.order, pluginName)
+}
+
+func (s *Service) removeFromOrder(pluginName string) {
+	for i, name := range s.order {
+		if name == pluginName {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+//dependents returns loaded plugins depend on pluginName
+func (s *Service) dependents(pluginName string) []string {
+	ret := make([]string, 0)
+	for _, name := range s.order {
+		for _, dep := range s.pluginConfigs[name].DependsOn {
+			if dep == pluginName {
+				ret = append(ret, name)
+			}
+		}
+	}
+	return ret
+}
+
+//waitReady routes msgs until plugin is running.
+//Plugin with wait_ready is running after it calls Ready.
+func (s *Service) waitReady(pluginName string) error {
+	pc := s.pluginConfigs[pluginName]
+	timeout := defaultReadyTimeout
+	if pc.ReadyTimeout != "" {
+		d, err := time.ParseDuration(pc.ReadyTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid ready_timeout %s of plugin %s: %v", pc.ReadyTimeout, pluginName, err)
+		}
+		timeout = d
+	}
+	deadline := time.Now().Add(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ready := func() (bool, error) {
+		if s.ready[pluginName] {
+			return true, nil
+		}
+		if err, ok := s.startErrs[pluginName]; ok {
+			if err == nil {
+				return false, NewError(ErrCodeUnavailable, "plugin %s returned from start before ready", pluginName)
+			}
+			return false, errors.Wrapf(err, "plugin %s returned from start before ready", pluginName)
+		}
+		if !time.Now().Before(deadline) {
+			return false, NewError(ErrCodeTimeout, "plugin %s isn't ready in %v", pluginName, timeout)
+		}
+		s.logger.Debug("waiting for plugin %s to be ready", pluginName)
+		return false, nil
+	}
+	stopped, err := s.serveUntil(ready, timer.C)
+	if !stopped {
+		return err
+	}
+	if err != nil {
+		return wrapError(err, "service stopped while waiting for %s", pluginName)
+	}
+	return errServiceStopped
+}
+
+//Ready tells service the plugin running with ctx is ready to serve,
+//plugins depend on it are started after that if it's configured with wait_ready
+func Ready(ctx context.Context) error {
+	msg := NewMsg(ChanKeyService, MsgPluginReady)
+	// tells the new version of plugin being upgraded from the running one
+	msg.SetRequest(map[string]interface{}{"start_id": ctx.Value(CtxKeyStartID)})
+	return SendMsg(ctx, msg)
+}
@@ -0,0 +1,273 @@
+package elsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lynic/elsvc/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//ErrCode classifies a MsgError, it's sent as code of proto MsgResponse
+type ErrCode int64
+
+const (
+	ErrCodeInternal    ErrCode = 1
+	ErrCodeTimeout     ErrCode = 2
+	ErrCodeNotFound    ErrCode = 3
+	ErrCodeRejected    ErrCode = 4
+	ErrCodeExpired     ErrCode = 5
+	ErrCodeUnavailable ErrCode = 6
+)
+
+func (s ErrCode) String() string {
+	switch s {
+	case ErrCodeInternal:
+		return "internal"
+	case ErrCodeTimeout:
+		return "timeout"
+	case ErrCodeNotFound:
+		return "not_found"
+	case ErrCodeRejected:
+		return "rejected"
+	case ErrCodeExpired:
+		return "expired"
+	case ErrCodeUnavailable:
+		return "unavailable"
+	}
+	return fmt.Sprintf("code_%d", int64(s))
+}
+
+//Well-known errors to check with errors.Is, only code is compared
+var (
+	ErrInternal    = &MsgError{Code: ErrCodeInternal, Message: "internal error"}
+	ErrTimeout     = &MsgError{Code: ErrCodeTimeout, Message: "timeout"}
+	ErrNotFound    = &MsgError{Code: ErrCodeNotFound, Message: "not found"}
+	ErrRejected    = &MsgError{Code: ErrCodeRejected, Message: "rejected"}
+	ErrExpired     = &MsgError{Code: ErrCodeExpired, Message: "expired"}
+	ErrUnavailable = &MsgError{Code: ErrCodeUnavailable, Message: "unavailable"}
+)
+
+//MsgError is the structured error carried by msgs across plugins
+type MsgError struct {
+	Code      ErrCode                `json:"code"`
+	Message   string                 `json:"message"`
+	Retryable bool                   `json:"retryable"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	cause     error                  // only available in the process creates it
+}
+
+//NewError create a MsgError, errors of timeout and unavailable are retryable
+func NewError(code ErrCode, format string, args ...interface{}) *MsgError {
+	return &MsgError{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		Retryable: code == ErrCodeTimeout || code == ErrCodeUnavailable,
+	}
+}
+
+func (e *MsgError) Error() string {
+	return e.Message
+}
+
+//Is reports whether target is a MsgError with the same code
+func (e *MsgError) Is(target error) bool {
+	t, ok := target.(*MsgError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code
+}
+
+func (e *MsgError) Unwrap() error {
+	return e.cause
+}
+
+func (e *MsgError) Timeout() bool {
+	return e.Code == ErrCodeTimeout
+}
+
+//WithDetail add a detail to e and returns e
+func (e *MsgError) WithDetail(key string, value interface{}) *MsgError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+//clone returns a copy of e, so details could be added without changing e
+func (e *MsgError) clone() *MsgError {
+	ret := *e
+	if e.Details != nil {
+		ret.Details = make(map[string]interface{}, len(e.Details))
+		for k, v := range e.Details {
+			ret.Details[k] = v
+		}
+	}
+	return &ret
+}
+
+//WithCause keep the cause of e for errors.Is in current process
+func (e *MsgError) WithCause(err error) *MsgError {
+	e.cause = err
+	return e
+}
+
+//AsMsgError convert err to MsgError, error without code is internal
+func AsMsgError(err error) *MsgError {
+	if err == nil {
+		return nil
+	}
+	var merr *MsgError
+	if errors.As(err, &merr) {
+		return merr
+	}
+	return NewError(ErrCodeInternal, "%s", err.Error()).WithCause(err)
+}
+
+//wrapError add context to message of err and keep its code
+func wrapError(err error, format string, args ...interface{}) *MsgError {
+	merr := AsMsgError(err).clone()
+	merr.Message = fmt.Sprintf(format, args...) + ": " + merr.Message
+	return merr.WithCause(err)
+}
+
+//ErrorCode returns code of err, 0 if err is nil
+func ErrorCode(err error) ErrCode {
+	if err == nil {
+		return 0
+	}
+	return AsMsgError(err).Code
+}
+
+//IsRetryable reports whether the request failed with err could be retried
+func IsRetryable(err error) bool {
+	var merr *MsgError
+	return errors.As(err, &merr) && merr.Retryable
+}
+
+//IsTimeout reports whether err is a timeout error
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout)
+}
+
+func newTimeoutError(msg MsgBase, err error) error {
+	return NewError(ErrCodeTimeout, "msg %s to %s timed out waiting for response: %v", msg.Type(), msg.To(), err).
+		WithDetail("msg_id", msg.ID()).
+		WithCause(err)
+}
+
+//rpcError convert error of a grpc call made for msg
+func rpcError(msg MsgBase, err error) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Canceled:
+		return newTimeoutError(msg, err)
+	case codes.Unavailable:
+		return NewError(ErrCodeUnavailable, "plugin of msg %s unavailable: %v", msg.Type(), err).WithCause(err)
+	}
+	return AsMsgError(err)
+}
+
+//errorValue convert "error" value in a msg payload to error,
+//it could be an error, a MsgError decoded from json or a plain string
+func errorValue(v interface{}) error {
+	switch e := v.(type) {
+	case nil:
+		return nil
+	case *MsgError:
+		if e == nil {
+			return nil
+		}
+		return e
+	case error:
+		return e
+	case string:
+		// sent by older plugins
+		if e == "" {
+			return nil
+		}
+		return NewError(ErrCodeInternal, "%s", e)
+	case map[string]interface{}:
+		// a map without code is some payload, not a MsgError
+		if _, ok := e["code"]; !ok {
+			return NewError(ErrCodeInternal, "%v", e)
+		}
+		data, _ := json.Marshal(e)
+		merr := &MsgError{}
+		if err := json.Unmarshal(data, merr); err != nil {
+			return NewError(ErrCodeInternal, "%v", e)
+		}
+		return merr
+	}
+	return NewError(ErrCodeInternal, "%v", v)
+}
+
+//decodeErrors convert "error" in payload to error
+func decodeErrors(payload map[string]interface{}) {
+	if v, ok := payload["error"]; ok {
+		if err := errorValue(v); err != nil {
+			payload["error"] = err
+		} else {
+			payload["error"] = nil
+		}
+	}
+}
+
+//encodedCopy returns a copy of payload with errors encoded, payload
+//itself is left as is since its msg may still be in use by others
+func encodedCopy(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		ret[k] = v
+	}
+	encodeErrors(ret)
+	return ret
+}
+
+//encodeErrors convert "error" in payload to MsgError, so it can be marshaled
+func encodeErrors(payload map[string]interface{}) {
+	if v, ok := payload["error"]; ok {
+		if merr := AsMsgError(errorValue(v)); merr != nil {
+			payload["error"] = merr
+		} else {
+			payload["error"] = nil
+		}
+	}
+}
+
+func protoError(err error) *proto.MsgError {
+	merr := AsMsgError(err)
+	if merr == nil {
+		return nil
+	}
+	ret := &proto.MsgError{
+		Code:      int64(merr.Code),
+		Message:   merr.Message,
+		Retryable: merr.Retryable,
+	}
+	if len(merr.Details) != 0 {
+		ret.Details, _ = json.Marshal(merr.Details)
+	}
+	return ret
+}
+
+func fromProtoError(perr *proto.MsgError) *MsgError {
+	if perr == nil {
+		return nil
+	}
+	merr := &MsgError{
+		Code:      ErrCode(perr.Code),
+		Message:   perr.Message,
+		Retryable: perr.Retryable,
+	}
+	if len(perr.Details) != 0 {
+		json.Unmarshal(perr.Details, &merr.Details)
+	}
+	return merr
+}
@@ -3,6 +3,7 @@ package elsvc
 import (
 	context "context"
 	"encoding/json"
+	"time"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/lynic/elsvc/proto"
@@ -14,11 +15,22 @@ const (
 	MsgFuncInit   = "func_init"
 	MsgFuncStart  = "func_start"
 	MsgFuncStop   = "func_stop"
+	MsgFuncHealth = "func_health"
+	MsgFuncConfig = "func_reconfigure"
+	MsgFuncInfo   = "func_info"
+	MsgFuncDrain  = "func_drain"
 	MsgSetEnv     = "set_env"
 	MsgStartError = "start_error"
 	MsgCtxDone    = "ctx_done"
 )
 
+//startRequest is the request of MsgFuncStart
+type startRequest struct {
+	BrokerID uint32        `json:"brokerID"`
+	Mailbox  mailboxConfig `json:"mailbox"`
+	Name     string        `json:"name"` // instance name of plugin, ModuleName by default
+}
+
 // This is the implementation of plugin.GRPCPlugin so we can serve/consume this.
 type GRPCPlugin struct {
 	// GRPCPlugin must still implement the Plugin interface
@@ -36,12 +48,13 @@ func (p *GRPCPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error
 
 func (p *GRPCPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
 	client := proto.NewPluginSvcClient(c)
-	return PluginClient{client: client, broker: broker}, nil
+	return PluginClient{client: client, broker: broker, conn: c}, nil
 }
 
 type PluginClient struct {
 	client proto.PluginSvcClient
 	broker *plugin.GRPCBroker
+	conn   *grpc.ClientConn
 }
 
 // func (*PluginServer) Log(ctx context.Context, req *proto.MsgLog) (*proto.MsgResponse, error) {
@@ -56,23 +69,49 @@ type PluginClient struct {
 func reqMsg(req *proto.MsgRequest) (MsgBase, error) {
 	msg := NewMsg(req.To, req.Type)
 	msg.MsgFrom = req.From
-	msg.MsgId = req.Id
+	if req.Id != "" {
+		msg.MsgId = req.Id
+		msg.CorrelationId = req.CorrelationId
+		msg.CausationId = req.CausationId
+	}
 	msg.TTL = int64(req.Ttl)
-	msg.SetRequestBytes(req.Request)
+	msg.WantReply = req.WantReply
+	msg.Priority = int(req.Priority)
+	msg.Headers = req.Headers
+	if req.Deadline != 0 {
+		msg.Deadline = time.Unix(0, req.Deadline)
+	}
+	err := msg.SetRequestBytes(req.Request)
+	if err != nil {
+		return msg, err
+	}
+	// structured error wins over the one in json
+	if merr := fromProtoError(req.Error); merr != nil {
+		msg.MsgRequest["error"] = merr
+	}
 	return msg, nil
 }
 
 func msgReq(msg MsgBase) (*proto.MsgRequest, error) {
 	ret := &proto.MsgRequest{
-		Id:      msg.ID(),
-		From:    msg.From(),
-		To:      msg.To(),
-		Type:    msg.Type(),
-		Ttl:     int64(msg.TTL),
-		Request: make([]byte, 0),
+		Id:            msg.ID(),
+		CorrelationId: msg.Correlation(),
+		CausationId:   msg.Causation(),
+		From:          msg.From(),
+		To:            msg.To(),
+		Type:          msg.Type(),
+		Ttl:           int64(msg.TTL),
+		WantReply:     msg.WantReply,
+		Priority:      int32(msg.Priority),
+		Headers:       msg.Headers,
+		Request:       make([]byte, 0),
+	}
+	if !msg.Deadline.IsZero() {
+		ret.Deadline = msg.Deadline.UnixNano()
 	}
-	if msg.GetRequest() != nil {
-		data, err := json.Marshal(msg.GetRequest())
+	if msg.MsgRequest != nil {
+		ret.Error = protoError(msg.GetRequestError())
+		data, err := json.Marshal(encodedCopy(msg.MsgRequest))
 		if err != nil {
 			return nil, err
 		}
@@ -84,21 +123,64 @@ func msgReq(msg MsgBase) (*proto.MsgRequest, error) {
 func respMsg(resp *proto.MsgResponse) (MsgBase, error) {
 	msg := NewMsg(resp.To, resp.Type)
 	msg.MsgFrom = resp.From
-	msg.MsgId = resp.Id
-	msg.SetResponseBytes(resp.Response)
-	return msg, nil
+	if resp.Id != "" {
+		msg.MsgId = resp.Id
+		msg.CorrelationId = resp.CorrelationId
+		msg.CausationId = resp.CausationId
+	}
+	err := setProtoResponse(&msg, resp)
+	return msg, err
+}
+
+//setProtoResponse set response of msg from proto response
+func setProtoResponse(msg *MsgBase, resp *proto.MsgResponse) error {
+	payload, err := unmarshalPayload(resp.Response)
+	if err != nil {
+		msg.SetError(NewError(ErrCodeInternal, "invalid response: %v", err))
+		return err
+	}
+	// structured error wins over the one in json
+	if merr := fromProtoError(resp.Error); merr != nil {
+		payload["error"] = merr
+	}
+	return msg.SetResponse(payload)
 }
 
 func msgResp(msg MsgBase) (*proto.MsgResponse, error) {
 	resp := &proto.MsgResponse{}
 	resp.Id = msg.ID()
+	resp.CorrelationId = msg.Correlation()
+	resp.CausationId = msg.Causation()
 	resp.From = msg.From()
 	resp.To = msg.To()
 	resp.Type = msg.Type()
 	resp.Response = msg.GetResponseBytes()
+	resp.Error = protoError(msg.GetError())
+	if resp.Error != nil {
+		resp.Code = resp.Error.Code
+	}
 	return resp, nil
 }
 
+//forwardMsg send msg through client and set the response back to msg.
+//The grpc call carries the deadline of msg.
+func forwardMsg(ctx context.Context, client proto.PluginSvcClient, msg MsgBase) error {
+	req, err := msgReq(msg)
+	if err != nil {
+		msg.SetError(err)
+		return err
+	}
+	ctx, cancel := msgContext(ctx, msg)
+	defer cancel()
+	resp, err := client.Request(ctx, req)
+	if err != nil {
+		err = rpcError(msg, err)
+		msg.SetError(err)
+		return err
+	}
+	return setProtoResponse(&msg, resp)
+}
+
 func HandshakeConf() plugin.HandshakeConfig {
 	return plugin.HandshakeConfig{
 		ProtocolVersion:  1,
@@ -0,0 +1,201 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHealthTimeout   = 5 * time.Second
+	defaultHealthThreshold = 3
+)
+
+//healthConfig is the validated health probing config of a plugin
+type healthConfig struct {
+	interval  time.Duration // no probing if it's 0
+	timeout   time.Duration
+	threshold int // probes failed in a row before plugin is restarted
+}
+
+func (s PluginConfig) healthConfig() (healthConfig, error) {
+	conf := healthConfig{
+		timeout:   defaultHealthTimeout,
+		threshold: s.HealthThreshold,
+	}
+	if s.HealthThreshold < 0 {
+		return conf, fmt.Errorf("invalid health_threshold %d", s.HealthThreshold)
+	}
+	if conf.threshold == 0 {
+		conf.threshold = defaultHealthThreshold
+	}
+	if s.HealthInterval == "" {
+		return conf, nil
+	}
+	interval, err := parseTimeout("health_interval", s.HealthInterval, 0)
+	if err != nil {
+		return conf, err
+	}
+	conf.interval = interval
+	if conf.timeout > interval {
+		conf.timeout = interval
+	}
+	conf.timeout, err = parseTimeout("health_timeout", s.HealthTimeout, conf.timeout)
+	if err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+//healthStatus is the result of health probes of a plugin
+type healthStatus struct {
+	live      bool
+	failures  int // probes failed in a row
+	lastProbe time.Time
+	lastErr   error
+}
+
+//startProbe probe plugin started with ctx if it's configured with health_interval
+func (s *Service) startProbe(ctx context.Context, pluginName string, pl PluginLoaderIntf) {
+	delete(s.health, pluginName)
+	conf, _ := s.pluginConfigs[pluginName].healthConfig()
+	if conf.interval == 0 {
+		return
+	}
+	hc, ok := pl.(HealthChecker)
+	if !ok {
+		s.logger.Error("plugin %s can't be probed for health", pluginName)
+		return
+	}
+	s.health[pluginName] = &healthStatus{live: true}
+	go s.probe(ctx, pluginName, hc, conf)
+}
+
+//probe check health of plugin every interval until ctx is done,
+//results are sent to service with MsgPluginHealth
+func (s *Service) probe(ctx context.Context, pluginName string, hc HealthChecker, conf healthConfig) {
+	ticker := time.NewTicker(conf.interval)
+	defer ticker.Stop()
+	startID, _ := ctx.Value(CtxKeyStartID).(string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := checkHealth(ctx, hc, conf.timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		msg := NewMsg(ChanKeyService, MsgPluginHealth)
+		msg.SetRequest(map[string]interface{}{
+			"plugin":   pluginName,
+			"start_id": startID,
+			"error":    err,
+		})
+		SendMsg(ctx, msg)
+	}
+}
+
+//checkHealth run Health of hc in timeout, even if it ignores ctx
+func checkHealth(ctx context.Context, hc HealthChecker, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- hc.Health(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return NewError(ErrCodeTimeout, "health check timed out in %v", timeout)
+	}
+}
+
+//handleHealthMsg update health of plugin with a probe result, plugin is
+//restarted if it fails too many probes. It returns true if service is stopped.
+func (s *Service) handleHealthMsg(msg MsgBase) (bool, error) {
+	pluginName, _ := msg.GetRequest()["plugin"].(string)
+	startID, _ := msg.GetRequest()["start_id"].(string)
+	st, ok := s.health[pluginName]
+	if !ok || startID != s.startIDs[pluginName] {
+		// plugin is unloaded or restarted already
+		return false, nil
+	}
+	conf, _ := s.pluginConfigs[pluginName].healthConfig()
+	wasLive, wasReady := st.live, s.healthReady(pluginName)
+	err := msg.GetRequestError()
+	st.lastProbe = time.Now()
+	st.lastErr = err
+	if err == nil {
+		st.failures = 0
+		st.live = true
+	} else {
+		st.failures++
+		s.logger.Error("plugin %s failed health probe %d/%d: %v", pluginName, st.failures, conf.threshold, err)
+		if st.failures >= conf.threshold {
+			st.live = false
+		}
+	}
+	if wasLive != st.live || wasReady != s.healthReady(pluginName) {
+		s.publishEvent(MsgHealthChanged, s.healthStatus(pluginName))
+	}
+	if wasLive && !st.live {
+		s.logger.Error("plugin %s failed %d health probes in a row, restarting it", pluginName, st.failures)
+		return s.restartUnhealthy(pluginName, err)
+	}
+	return false, nil
+}
+
+//healthReady reports whether plugin is ready and passed its last probe
+func (s *Service) healthReady(pluginName string) bool {
+	if st, ok := s.health[pluginName]; ok && st.failures > 0 {
+		return false
+	}
+	return s.ready[pluginName]
+}
+
+//healthStatus returns liveness and readiness of plugin,
+//plugin without probing is live while it's loaded
+func (s *Service) healthStatus(pluginName string) map[string]interface{} {
+	_, loaded := s.Plugins[pluginName]
+	status := map[string]interface{}{
+		"plugin": pluginName,
+		"live":   loaded,
+		"ready":  loaded && s.healthReady(pluginName),
+		"probed": false,
+	}
+	if st, ok := s.health[pluginName]; ok {
+		status["live"] = loaded && st.live
+		status["probed"] = true
+		status["failures"] = st.failures
+		if !st.lastProbe.IsZero() {
+			status["last_probe"] = st.lastProbe
+		}
+		if st.lastErr != nil {
+			status["error"] = AsMsgError(st.lastErr)
+		}
+	}
+	return status
+}
+
+//restartUnhealthy restart plugin failed health probes whatever its restart
+//policy is, restarts are limited and escalated as the ones of restart policy
+func (s *Service) restartUnhealthy(pluginName string, err error) (bool, error) {
+	if state, ok := s.supervised[pluginName]; ok && state.restartID != "" {
+		// restart scheduled already
+		return false, nil
+	}
+	pc := s.pluginConfigs[pluginName]
+	policy, _ := pc.restartPolicy()
+	return s.scheduleRestart(pluginName, pc, policy, err)
+}
+
+//publishEvent publish a lifecycle event of plugins on TopicPluginEvents
+func (s *Service) publishEvent(msgType string, req map[string]interface{}) {
+	msg := NewMsg(TopicPluginEvents, msgType)
+	msg.MsgFrom = ChanKeyService
+	msg.SetRequest(req)
+	s.publishMsg(msg)
+}
@@ -0,0 +1,38 @@
+package elsvc
+
+import "time"
+
+//APIVersion is the version of elsvc API plugins are built against, plugins
+//needing a newer minor version or another major version aren't loaded
+const APIVersion = "1.0.0"
+
+//infoTimeout is how long host waits for metadata of a hcplugin at load,
+//plugins built before func_info never answer
+const infoTimeout = 2 * time.Second
+
+//PluginMeta describes a plugin, see PluginInfo
+type PluginMeta struct {
+	Version     string   `json:"version"`
+	Description string   `json:"description,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	APIVersion  string   `json:"api_version,omitempty"` // minimum elsvc API version plugin needs
+	MsgTypes    []string `json:"msg_types,omitempty"`   // msg types plugin handles
+}
+
+//checkAPIVersion fails if host doesn't support the API version plugin needs
+func checkAPIVersion(pluginName string, meta *PluginMeta) error {
+	if meta == nil || meta.APIVersion == "" {
+		return nil
+	}
+	need, err := parseSemver(meta.APIVersion)
+	if err != nil {
+		return NewError(ErrCodeRejected, "plugin %s declares invalid api_version: %v", pluginName, err)
+	}
+	host, _ := parseSemver(APIVersion)
+	if need.major != host.major || need.compare(host) > 0 {
+		return NewError(ErrCodeRejected, "plugin %s needs elsvc API %s, host supports %s", pluginName, meta.APIVersion, APIVersion).
+			WithDetail("api_version", meta.APIVersion).
+			WithDetail("host_api_version", APIVersion)
+	}
+	return nil
+}
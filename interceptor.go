@@ -0,0 +1,210 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//PluginKindInterceptor is the kind of plugin intercepting routed msgs
+const PluginKindInterceptor = "interceptor"
+
+const defaultInterceptTimeout = time.Second
+
+//Interceptor sees msgs routed by service before delivery.
+//It could modify msg in place, e.g. request or headers,
+//or return an error to reject msg, the error is replied to sender.
+type Interceptor func(msg *MsgBase) error
+
+type interceptor struct {
+	name   string
+	order  int
+	fn     Interceptor
+	plugin bool // plugin asked with MsgIntercept off routing loop, fn is nil
+}
+
+//interceptorChain runs interceptors by order, ones with the same order
+//run in the order they are added
+type interceptorChain struct {
+	mut   sync.RWMutex
+	items []interceptor
+}
+
+func (s *interceptorChain) add(item interceptor) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, it := range s.items {
+		if it.name == item.name {
+			return fmt.Errorf("interceptor %s exists already", item.name)
+		}
+	}
+	s.items = append(s.items, item)
+	sort.SliceStable(s.items, func(i, j int) bool {
+		return s.items[i].order < s.items[j].order
+	})
+	return nil
+}
+
+func (s *interceptorChain) remove(name string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for i, item := range s.items {
+		if item.name == name {
+			s.items = append(s.items[:i:i], s.items[i+1:]...)
+			return
+		}
+	}
+}
+
+//run pass msg through interceptors not in done, msgs from an interceptor skip itself.
+//It stops at the first interceptor plugin and returns it, msg is passed to the
+//ones after it when the plugin replies.
+func (s *interceptorChain) run(msg *MsgBase, done map[string]bool) (*interceptor, error) {
+	s.mut.RLock()
+	items := s.items
+	s.mut.RUnlock()
+	for i, item := range items {
+		if item.name == msg.From() || done[item.name] {
+			continue
+		}
+		if item.plugin {
+			return &items[i], nil
+		}
+		if err := item.fn(msg); err != nil {
+			return nil, interceptError(item.name, err)
+		}
+	}
+	return nil, nil
+}
+
+func interceptError(name string, err error) *MsgError {
+	return AsMsgError(err).clone().WithDetail("interceptor", name)
+}
+
+//AddInterceptor add fn to intercept msgs routed by service,
+//interceptors run by order from low to high
+func (s *Service) AddInterceptor(name string, order int, fn Interceptor) error {
+	return s.interceptors.add(interceptor{name: name, order: order, fn: fn})
+}
+
+//RemoveInterceptor remove interceptor by name
+func (s *Service) RemoveInterceptor(name string) {
+	s.interceptors.remove(name)
+}
+
+//pendingIntercept is a msg waiting for the verdict of an interceptor plugin
+type pendingIntercept struct {
+	msg         MsgBase
+	interceptor string
+	done        map[string]bool // interceptors msg passed already
+}
+
+//interceptMsg pass msg through interceptors not in done, then deliver it.
+//Msg is handed to an interceptor plugin without blocking routing loop,
+//it goes on with the next interceptors when MsgInterceptDone comes back.
+func (s *Service) interceptMsg(msg MsgBase, done map[string]bool) {
+	item, err := s.interceptors.run(&msg, done)
+	if err != nil {
+		s.rejectMsg(msg, err)
+		return
+	}
+	if item != nil {
+		s.askInterceptor(item.name, msg, done)
+		return
+	}
+	// copy message to subscribers of topic
+	if isTopic(msg.To()) {
+		s.publishMsg(msg)
+		return
+	}
+	// route message to corresponding chan
+	s.routeMsg(msg)
+}
+
+//askInterceptor send msg to interceptor plugin with MsgIntercept, and wait for
+//its reply in background. Msg is rejected if plugin doesn't reply in time.
+func (s *Service) askInterceptor(pluginName string, msg MsgBase, done map[string]bool) {
+	mb, ok := s.mailboxes[pluginName]
+	// fail fast instead of waiting for a plugin which can't reply
+	if !ok || s.pluginState(pluginName) != StateRunning {
+		s.rejectMsg(msg, interceptError(pluginName, NewError(ErrCodeUnavailable, "interceptor plugin %s isn't available", pluginName)))
+		return
+	}
+	imsg := msg.Derive(pluginName, MsgIntercept)
+	imsg.MsgFrom = ChanKeyService
+	imsg.Priority = PriorityHigh
+	imsg.WantReply = true
+	imsg.Deadline = time.Now().Add(defaultInterceptTimeout)
+	imsg.SetRequest(map[string]interface{}{"msg": msgRecord(msg)})
+	if done == nil {
+		done = make(map[string]bool)
+	}
+	s.intercepts[imsg.ID()] = &pendingIntercept{msg: msg, interceptor: pluginName, done: done}
+	s.deliverMsg(mb, imsg)
+	result := NewMsg(ChanKeyService, MsgInterceptDone)
+	result.MsgFrom = ChanKeyService
+	svcChan := s.Chans[ChanKeyService]
+	stopped := s.done
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), imsg.Deadline)
+		defer cancel()
+		verdict := map[string]interface{}{"id": imsg.ID()}
+		resp, err := imsg.GetResponseContext(ctx)
+		if err == nil {
+			err = imsg.GetError()
+		}
+		if err != nil {
+			verdict["error"] = err
+		} else if record, ok := resp["msg"].(map[string]interface{}); ok {
+			verdict["msg"] = record
+		}
+		result.SetRequest(verdict)
+		select {
+		case svcChan <- result:
+		case <-stopped:
+		}
+	}()
+}
+
+//handleInterceptDone apply verdict of interceptor plugin to the msg waiting for it,
+//and pass msg to the next interceptors
+func (s *Service) handleInterceptDone(msg MsgBase) {
+	id, _ := msg.GetRequest()["id"].(string)
+	p, ok := s.intercepts[id]
+	if !ok {
+		return
+	}
+	delete(s.intercepts, id)
+	if err := msg.GetRequestError(); err != nil {
+		s.rejectMsg(p.msg, interceptError(p.interceptor, err))
+		return
+	}
+	// msg is accepted as it is if there's no record
+	if record, ok := msg.GetRequest()["msg"].(map[string]interface{}); ok {
+		// only payload of msg could be changed by interceptor plugin
+		changed := recordMsg(record)
+		p.msg.MsgRequest = changed.MsgRequest
+		p.msg.Headers = changed.Headers
+		p.msg.Priority = changed.Priority
+	}
+	p.done[p.interceptor] = true
+	s.interceptMsg(p.msg, p.done)
+}
+
+//InterceptedMsg returns the msg carried by a MsgIntercept msg,
+//used by interceptor plugins
+func InterceptedMsg(msg MsgBase) (MsgBase, error) {
+	record, ok := msg.GetRequest()["msg"].(map[string]interface{})
+	if !ok {
+		return MsgBase{}, NewError(ErrCodeRejected, "msg %s doesn't carry an intercepted msg", msg.Type())
+	}
+	return recordMsg(record), nil
+}
+
+//ReplyIntercepted accept the intercepted msg with its request, headers
+//and priority replaced by the ones in changed
+func ReplyIntercepted(msg *MsgBase, changed MsgBase) error {
+	return msg.SetResponse(map[string]interface{}{"msg": msgRecord(changed)})
+}
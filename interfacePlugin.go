@@ -9,6 +9,24 @@ type PluginIntf interface {
 	Stop(context.Context) error
 }
 
+//HealthChecker is implemented by plugins could be probed for health,
+//Health returns nil if plugin is healthy
+type HealthChecker interface {
+	Health(context.Context) error
+}
+
+//PluginInfo is implemented by plugins describing themselves,
+//it's checked when plugin is loaded and shown in plugin listings
+type PluginInfo interface {
+	Info() PluginMeta
+}
+
+//Reconfigurer is implemented by plugins could apply a new config without restarting,
+//Reconfigure gets the new config with GetConfig
+type Reconfigurer interface {
+	Reconfigure(context.Context) error
+}
+
 // type MessageIntf interface {
 // 	To() string
 // 	From() string
@@ -0,0 +1,263 @@
+package elsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//Statuses of jobs in job summary
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobSkipped   = "skipped" // a job it depends on didn't succeed
+	JobTimedOut  = "timed_out"
+	JobCancelled = "cancelled" // service stopped before job finished
+)
+
+//JobResult is the outcome of a job plugin
+type JobResult struct {
+	Plugin     string                 `json:"plugin"`
+	Status     string                 `json:"status"`
+	Result     map[string]interface{} `json:"result,omitempty"` // set by plugin with SetJobResult
+	Error      *MsgError              `json:"error,omitempty"`
+	StartedAt  *time.Time             `json:"started_at,omitempty"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+	Duration   string                 `json:"duration,omitempty"`
+}
+
+func (s *JobResult) finished() bool {
+	return s.Status != JobPending && s.Status != JobRunning
+}
+
+func (s *JobResult) start() {
+	now := time.Now()
+	s.StartedAt = &now
+	s.Status = JobRunning
+}
+
+//finish record job returned with err
+func (s *JobResult) finish(err error) {
+	now := time.Now()
+	s.FinishedAt = &now
+	if s.StartedAt != nil {
+		s.Duration = now.Sub(*s.StartedAt).String()
+	}
+	s.Status = JobSucceeded
+	if err != nil {
+		s.Status = JobFailed
+		s.Error = AsMsgError(err)
+	}
+}
+
+//JobSummary is written when service exits in job mode
+type JobSummary struct {
+	Succeeded bool         `json:"succeeded"`
+	Error     *MsgError    `json:"error,omitempty"` // why service stopped before jobs finished
+	Duration  string       `json:"duration"`
+	Jobs      []*JobResult `json:"jobs"`
+}
+
+//jobTimeout returns the validated time for all jobs to finish, 0 if there's no limit
+func (s ServiceConfig) jobTimeout() (time.Duration, error) {
+	return parseTimeout("job_timeout", s.JobTimeout, 0)
+}
+
+//isJob reports whether service waits for Start of plugin to return in job mode,
+//plugins serving jobs are daemons
+func (s *Service) isJob(pluginName string) bool {
+	_, ok := s.jobs[pluginName]
+	return ok
+}
+
+//SetJobResult set result of the job plugin running with ctx,
+//it's reported in job summary when its Start returns
+func SetJobResult(ctx context.Context, result map[string]interface{}) error {
+	msg := NewMsg(ChanKeyService, MsgJobResult)
+	msg.SetRequest(result)
+	return SendMsg(ctx, msg)
+}
+
+//startJobMode run job plugins to completion, plugins serving them are stopped
+//after that. A summary of jobs is written, it returns an error if any job failed.
+func (s *Service) startJobMode() error {
+	s.jobsStarted = time.Now()
+	for _, name := range s.order {
+		pc := s.pluginConfigs[name]
+		if pc.Daemon || pc.Kind == PluginKindInterceptor {
+			continue
+		}
+		s.jobs[name] = &JobResult{Plugin: name, Status: JobPending}
+	}
+	if timeout, _ := s.config.jobTimeout(); timeout > 0 {
+		msg := NewMsg(ChanKeyService, MsgJobTimeout)
+		msg.MsgFrom = ChanKeyService
+		msg.SetRequest(map[string]interface{}{"timeout": timeout.String()})
+		svcChan := s.Chans[ChanKeyService]
+		done := s.done
+		timer := time.AfterFunc(timeout, func() {
+			select {
+			case svcChan <- msg:
+			case <-done:
+			}
+		})
+		defer timer.Stop()
+	}
+	err := s.StartPlugins()
+	if err == nil && !s.jobsDone() {
+		err = s.serve()
+	}
+	if err == errServiceStopped {
+		err = nil
+	}
+	s.abortJobs(err)
+	// stop daemons
+	serr := s.Stop()
+	if serr != nil {
+		s.logger.Error("failed to stop service: %v", serr)
+	}
+	return s.finishJobs(err)
+}
+
+//jobStarted record job plugin is started, or failed to start with err
+func (s *Service) jobStarted(pluginName string, err error) {
+	s.jobs[pluginName].start()
+	if err != nil {
+		s.jobExited(pluginName, err)
+	}
+}
+
+//jobExited record Start of job plugin returned with err
+func (s *Service) jobExited(pluginName string, err error) {
+	job := s.jobs[pluginName]
+	if job.finished() {
+		return
+	}
+	job.finish(err)
+	s.logger.Info("job %s %s", pluginName, job.Status)
+}
+
+//skipJob record job plugin isn't run as job it depends on didn't succeed
+func (s *Service) skipJob(pluginName, dep string) {
+	job := s.jobs[pluginName]
+	job.Status = JobSkipped
+	job.Error = NewError(ErrCodeUnavailable, "job %s depends on %s which didn't succeed", pluginName, dep).
+		WithDetail("depends_on", dep)
+	s.logger.Error("%v", job.Error)
+}
+
+//jobsDone reports whether all jobs are finished
+func (s *Service) jobsDone() bool {
+	for _, job := range s.jobs {
+		if !job.finished() {
+			return false
+		}
+	}
+	return true
+}
+
+//waitJob wait for job plugin to finish, it returns false if the job didn't succeed
+func (s *Service) waitJob(pluginName string) (bool, error) {
+	job := s.jobs[pluginName]
+	finished := func() (bool, error) {
+		if job.finished() {
+			return true, nil
+		}
+		s.logger.Debug("waiting for job %s to finish", pluginName)
+		return false, nil
+	}
+	stopped, err := s.serveUntil(finished, nil)
+	if stopped {
+		if err != nil {
+			return false, wrapError(err, "service stopped while waiting for %s", pluginName)
+		}
+		return false, errServiceStopped
+	}
+	return job.Status == JobSucceeded, nil
+}
+
+//abortJobs record jobs not finished when service stops early with err
+func (s *Service) abortJobs(err error) {
+	status, code := JobCancelled, ErrCodeUnavailable
+	if IsTimeout(err) {
+		status, code = JobTimedOut, ErrCodeTimeout
+	}
+	now := time.Now()
+	for name, job := range s.jobs {
+		if job.finished() {
+			continue
+		}
+		if job.StartedAt != nil {
+			job.FinishedAt = &now
+			job.Duration = now.Sub(*job.StartedAt).String()
+		}
+		job.Status = status
+		job.Error = NewError(code, "job %s didn't finish: %s", name, status).WithCause(err)
+		s.logger.Error("%v", job.Error)
+	}
+}
+
+//finishJobs write summary of jobs, err is the one stopping service early
+func (s *Service) finishJobs(err error) error {
+	summary := JobSummary{
+		Succeeded: err == nil,
+		Error:     AsMsgError(err),
+		Duration:  time.Since(s.jobsStarted).String(),
+		Jobs:      make([]*JobResult, 0, len(s.jobs)),
+	}
+	failed := 0
+	for _, name := range s.jobOrder() {
+		job := s.jobs[name]
+		if job.Status != JobSucceeded {
+			failed++
+		}
+		summary.Jobs = append(summary.Jobs, job)
+	}
+	if failed > 0 {
+		summary.Succeeded = false
+	}
+	werr := s.writeJobSummary(summary)
+	if werr != nil {
+		s.logger.Error("failed to write job summary: %v", werr)
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(s.jobs))
+	}
+	return werr
+}
+
+//jobOrder returns jobs in the order of config
+func (s *Service) jobOrder() []string {
+	names := make([]string, 0, len(s.jobs))
+	for _, pc := range s.config.Plugins {
+		if _, ok := s.jobs[pc.InstanceName()]; ok {
+			names = append(names, pc.InstanceName())
+		}
+	}
+	return names
+}
+
+//writeJobSummary write summary to job_summary of config, or stdout if it's -
+func (s *Service) writeJobSummary(summary JobSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.logger.Info("job summary: %s", data)
+	switch s.config.JobSummary {
+	case "":
+		return nil
+	case "-":
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+		return err
+	}
+	return ioutil.WriteFile(s.config.JobSummary, data, 0644)
+}
@@ -0,0 +1,170 @@
+package elsvc
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//PluginState is the lifecycle state of a plugin
+type PluginState string
+
+//Lifecycle states of plugin, a plugin goes
+//loaded -> initialized -> starting -> running -> stopping -> stopped or failed
+const (
+	StateLoaded      PluginState = "loaded"
+	StateInitialized PluginState = "initialized"
+	StateStarting    PluginState = "starting" // waiting for Ready if plugin is configured with wait_ready
+	StateRunning     PluginState = "running"
+	StateStopping    PluginState = "stopping"
+	StateStopped     PluginState = "stopped"
+	StateFailed      PluginState = "failed"
+)
+
+//transitions are the states a plugin could move to from a state
+var transitions = map[PluginState][]PluginState{
+	"":               {StateLoaded},
+	StateLoaded:      {StateInitialized, StateStopping, StateFailed},
+	StateInitialized: {StateStarting, StateStopping, StateFailed},
+	StateStarting:    {StateRunning, StateStopping, StateStopped, StateFailed},
+	StateRunning:     {StateStopping, StateStopped, StateFailed},
+	StateStopping:    {StateStopped, StateFailed},
+	StateStopped:     {StateLoaded, StateStopping, StateFailed},
+	StateFailed:      {StateLoaded, StateStopping},
+}
+
+func canTransit(from, to PluginState) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+//pluginStatus is the lifecycle of a plugin, it's kept after plugin is unloaded
+type pluginStatus struct {
+	state      PluginState
+	pluginType string
+	version    string
+	path       string
+	mode       string
+	kind       string
+	meta       *PluginMeta
+	since      time.Time // when plugin moved to state
+	startedAt  time.Time
+	lastErr    error
+}
+
+//setState move plugin to state, err is kept as the last error of plugin if it's not nil.
+//It fails if plugin can't move to state from its current one.
+func (s *Service) setState(pluginName string, state PluginState, err error) error {
+	if err := s.checkState(pluginName, state); err != nil {
+		return err
+	}
+	st, ok := s.states[pluginName]
+	if !ok {
+		st = &pluginStatus{}
+		s.states[pluginName] = st
+	}
+	from := st.state
+	now := time.Now()
+	st.state = state
+	st.since = now
+	if state == StateStarting {
+		st.startedAt = now
+	}
+	if err != nil {
+		st.lastErr = err
+	}
+	s.logger.Debug("plugin %s: %s -> %s", pluginName, from, state)
+	event := map[string]interface{}{
+		"plugin": pluginName,
+		"from":   string(from),
+		"to":     string(state),
+	}
+	if err != nil {
+		event["error"] = AsMsgError(err)
+	}
+	s.publishEvent(MsgStateChanged, event)
+	return nil
+}
+
+//mustSetState is setState for transitions service makes sure are allowed
+func (s *Service) mustSetState(pluginName string, state PluginState, err error) {
+	if serr := s.setState(pluginName, state, err); serr != nil {
+		s.logger.Error("%v", serr)
+	}
+}
+
+//failPlugin move plugin to failed, or update its last error if it's failed already
+func (s *Service) failPlugin(pluginName string, err error) {
+	if s.pluginState(pluginName) == StateFailed {
+		if err != nil {
+			s.states[pluginName].lastErr = err
+		}
+		return
+	}
+	s.mustSetState(pluginName, StateFailed, err)
+}
+
+//checkState fails if plugin can't move to state
+func (s *Service) checkState(pluginName string, state PluginState) error {
+	from := PluginState("")
+	if st, ok := s.states[pluginName]; ok {
+		from = st.state
+	}
+	if canTransit(from, state) {
+		return nil
+	}
+	if from == "" {
+		return NewError(ErrCodeNotFound, "plugin %s isn't loaded", pluginName)
+	}
+	return NewError(ErrCodeRejected, "plugin %s can't be %s while it's %s", pluginName, state, from).
+		WithDetail("state", string(from))
+}
+
+//pluginState returns the current state of plugin, empty if it's never loaded
+func (s *Service) pluginState(pluginName string) PluginState {
+	if st, ok := s.states[pluginName]; ok {
+		return st.state
+	}
+	return ""
+}
+
+//statusOf returns lifecycle status of plugin for listing
+func (s *Service) statusOf(pluginName string) map[string]interface{} {
+	st := s.states[pluginName]
+	status := map[string]interface{}{
+		"state":   string(st.state),
+		"type":    st.pluginType,
+		"version": st.version,
+		"path":    st.path,
+		"mode":    st.mode,
+		"since":   st.since,
+	}
+	if st.kind != "" {
+		status["kind"] = st.kind
+	}
+	if st.meta != nil {
+		status["info"] = st.meta
+	}
+	if !st.startedAt.IsZero() {
+		status["started_at"] = st.startedAt
+	}
+	if st.lastErr != nil {
+		status["last_error"] = AsMsgError(st.lastErr)
+	}
+	return status
+}
+
+//soVersion returns version of plugin binary named <plugin>.so.<version>,
+//empty if it has no version
+func soVersion(pluginPath string) string {
+	name := filepath.Base(pluginPath)
+	i := strings.Index(name, ".so.")
+	if i < 0 {
+		return ""
+	}
+	return name[i+len(".so."):]
+}
@@ -0,0 +1,388 @@
+package elsvc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Priorities of msg, msg is normal by default
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+//Overflow policies, what to do with a msg when its lane is full, reject by default.
+//Block waits in the routing loop of service, no msg to any plugin is routed
+//until there's room or block timeout, keep it short if a plugin uses it.
+const (
+	OverflowBlock      = "block"       // wait for room until block timeout, then drop the msg
+	OverflowDropOldest = "drop_oldest" // drop the oldest msg in lane to make room
+	OverflowDropNewest = "drop_newest" // drop the incoming msg
+	OverflowReject     = "reject"      // reply an error to the sender of incoming msg
+)
+
+const defaultBlockTimeout = time.Second
+
+//LaneConfig configs a lane of plugin in-chan,
+//msg goes to the lane with the highest priority not above its own
+type LaneConfig struct {
+	Priority int `json:"priority"`
+	Weight   int `json:"weight"` // share of deliveries when other lanes are busy too
+	Length   int `json:"length"` // capacity, ChanLength of plugin by default
+}
+
+func defaultLanes(length int) []LaneConfig {
+	return []LaneConfig{
+		{Priority: PriorityHigh, Weight: 8, Length: length},
+		{Priority: PriorityNormal, Weight: 4, Length: length},
+		{Priority: PriorityLow, Weight: 1, Length: length},
+	}
+}
+
+//mailboxConfig is the validated queue config of a plugin,
+//it's passed to plugin process in hcplugin mode
+type mailboxConfig struct {
+	Lanes        []LaneConfig  `json:"lanes"`
+	Overflow     string        `json:"overflow"`
+	BlockTimeout time.Duration `json:"block_timeout"`
+}
+
+//newMailboxConfig check queue config and fill in defaults
+func newMailboxConfig(lanes []LaneConfig, chanLength int, overflow, blockTimeout string) (mailboxConfig, error) {
+	conf := mailboxConfig{
+		Overflow:     overflow,
+		BlockTimeout: defaultBlockTimeout,
+	}
+	if chanLength < 0 {
+		return conf, fmt.Errorf("invalid chan_length %d", chanLength)
+	}
+	if chanLength == 0 {
+		chanLength = defaultChanLength
+	}
+	switch overflow {
+	case "":
+		// a full plugin mustn't stall routing to the others
+		conf.Overflow = OverflowReject
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowReject:
+	default:
+		return conf, fmt.Errorf("overflow policy %s is none of %s, %s, %s, %s",
+			overflow, OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowReject)
+	}
+	if blockTimeout != "" {
+		d, err := time.ParseDuration(blockTimeout)
+		if err != nil {
+			return conf, fmt.Errorf("invalid block_timeout %s: %v", blockTimeout, err)
+		}
+		if d <= 0 {
+			return conf, fmt.Errorf("block_timeout %s must be positive", blockTimeout)
+		}
+		conf.BlockTimeout = d
+	}
+	if len(lanes) == 0 {
+		conf.Lanes = defaultLanes(chanLength)
+		return conf, nil
+	}
+	conf.Lanes = make([]LaneConfig, 0, len(lanes))
+	seen := make(map[int]bool)
+	for _, lc := range lanes {
+		if seen[lc.Priority] {
+			return conf, fmt.Errorf("duplicated lane of priority %d", lc.Priority)
+		}
+		seen[lc.Priority] = true
+		if lc.Weight < 0 || lc.Length < 0 {
+			return conf, fmt.Errorf("invalid lane of priority %d: weight and length can't be negative", lc.Priority)
+		}
+		if lc.Weight == 0 {
+			lc.Weight = 1
+		}
+		if lc.Length == 0 {
+			lc.Length = chanLength
+		}
+		conf.Lanes = append(conf.Lanes, lc)
+	}
+	return conf, nil
+}
+
+type lane struct {
+	LaneConfig
+	ch        chan interface{}
+	current   int    // current weight of smooth weighted round robin
+	overflows uint64 // times a msg found the lane full
+	dropped   uint64 // msgs dropped for overflow
+}
+
+//mailbox keeps msgs of a plugin in lanes by priority, and feeds them
+//to the in-chan of plugin. Higher lanes are favoured by weight,
+//lower lanes still get their share so they never starve.
+type mailbox struct {
+	name    string
+	conf    mailboxConfig
+	lanes   []*lane // sorted by priority, highest first
+	out     chan interface{}
+	onDrop  func(v interface{}, err error) // called with msgs dropped for overflow
+	notify  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	outs    chan chan interface{} // switches out, see switchOut
+	inHand  int32                 // 1 if run holds a msg not delivered to out yet
+	// msg run held when mailbox is closed, see drain
+	held interface{}
+	// puts in progress hold it for read, close waits for them
+	closing sync.RWMutex
+}
+
+//newMailbox create a mailbox feeding out, conf must be validated
+func newMailbox(name string, conf mailboxConfig, out chan interface{}, onDrop func(interface{}, error)) *mailbox {
+	mb := &mailbox{
+		name:    name,
+		conf:    conf,
+		lanes:   make([]*lane, 0, len(conf.Lanes)),
+		out:     out,
+		outs:    make(chan chan interface{}),
+		onDrop:  onDrop,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, lc := range conf.Lanes {
+		mb.lanes = append(mb.lanes, &lane{
+			LaneConfig: lc,
+			ch:         make(chan interface{}, lc.Length),
+		})
+	}
+	sort.Slice(mb.lanes, func(i, j int) bool {
+		return mb.lanes[i].Priority > mb.lanes[j].Priority
+	})
+	return mb
+}
+
+//lane returns the lane for msgs of priority
+func (s *mailbox) lane(priority int) *lane {
+	for _, l := range s.lanes {
+		if l.Priority <= priority {
+			return l
+		}
+	}
+	return s.lanes[len(s.lanes)-1]
+}
+
+//put v into its lane, overflow policy applies if the lane is full.
+//Msgs dropped are passed to onDrop, error is returned if v is rejected.
+func (s *mailbox) put(v interface{}) error {
+	s.closing.RLock()
+	defer s.closing.RUnlock()
+	// a closed mailbox takes no msg, even if its lane has room
+	select {
+	case <-s.done:
+		return s.closedError()
+	default:
+	}
+	priority := PriorityNormal
+	if msg, ok := v.(MsgBase); ok {
+		priority = msg.Priority
+	}
+	l := s.lane(priority)
+	select {
+	case l.ch <- v:
+		s.wake()
+		return nil
+	case <-s.done:
+		return s.closedError()
+	default:
+	}
+	atomic.AddUint64(&l.overflows, 1)
+	switch s.conf.Overflow {
+	case OverflowDropNewest:
+		s.drop(l, v, s.overflowError(l))
+	case OverflowDropOldest:
+		for {
+			select {
+			case l.ch <- v:
+				s.wake()
+				return nil
+			default:
+			}
+			// run may take the oldest at the same time, then try again
+			select {
+			case old := <-l.ch:
+				s.drop(l, old, s.overflowError(l))
+			default:
+			}
+		}
+	case OverflowReject:
+		atomic.AddUint64(&l.dropped, 1)
+		return s.overflowError(l)
+	default:
+		timer := time.NewTimer(s.conf.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case l.ch <- v:
+			s.wake()
+		case <-timer.C:
+			s.drop(l, v, NewError(ErrCodeTimeout, "lane %d of %s is still full after %v",
+				l.Priority, s.name, s.conf.BlockTimeout).WithDetail("overflow", s.conf.Overflow))
+		case <-s.done:
+			return s.closedError()
+		}
+	}
+	return nil
+}
+
+func (s *mailbox) drop(l *lane, v interface{}, err error) {
+	atomic.AddUint64(&l.dropped, 1)
+	if s.onDrop != nil {
+		s.onDrop(v, err)
+	}
+}
+
+func (s *mailbox) overflowError(l *lane) *MsgError {
+	merr := NewError(ErrCodeRejected, "lane %d of %s is full", l.Priority, s.name).
+		WithDetail("overflow", s.conf.Overflow)
+	// the lane may have room later
+	merr.Retryable = true
+	return merr
+}
+
+func (s *mailbox) closedError() *MsgError {
+	return NewError(ErrCodeUnavailable, "mailbox of %s is closed", s.name)
+}
+
+func (s *mailbox) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+//next pick the lane to deliver from, nil if all lanes are empty
+func (s *mailbox) next() *lane {
+	total := 0
+	var best *lane
+	for _, l := range s.lanes {
+		if len(l.ch) == 0 {
+			continue
+		}
+		l.current += l.Weight
+		total += l.Weight
+		if best == nil || l.current > best.current {
+			best = l
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+//run deliver msgs to out until mailbox is closed
+func (s *mailbox) run() {
+	defer close(s.stopped)
+	for {
+		l := s.next()
+		if l == nil {
+			select {
+			case <-s.notify:
+				continue
+			case out := <-s.outs:
+				s.out = out
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		var v interface{}
+		select {
+		case v = <-l.ch:
+		default:
+			// taken by put for drop_oldest
+			continue
+		}
+		atomic.StoreInt32(&s.inHand, 1)
+		for delivered := false; !delivered; {
+			select {
+			case s.out <- v:
+				delivered = true
+			case out := <-s.outs:
+				// v goes to the new out
+				s.out = out
+			case <-s.done:
+				// left to drain
+				s.held = v
+				return
+			}
+		}
+		atomic.StoreInt32(&s.inHand, 0)
+	}
+}
+
+//switchOut deliver msgs to out from now on, it returns after the switch,
+//msgs delivered to the old out before are left there
+func (s *mailbox) switchOut(out chan interface{}) {
+	select {
+	case s.outs <- out:
+	case <-s.done:
+	}
+}
+
+//pending returns number of msgs not delivered to out yet
+func (s *mailbox) pending() int {
+	n := int(atomic.LoadInt32(&s.inHand))
+	for _, l := range s.lanes {
+		n += len(l.ch)
+	}
+	return n
+}
+
+//close stop delivering and wait for run to return. Puts in progress end
+//before it returns, so msgs not delivered are all left to drain.
+func (s *mailbox) close() {
+	close(s.done)
+	s.closing.Lock()
+	s.closing.Unlock()
+	<-s.stopped
+}
+
+//drain returns msgs not delivered to out, call it after close
+func (s *mailbox) drain() []interface{} {
+	left := make([]interface{}, 0)
+	if s.held != nil {
+		left = append(left, s.held)
+		s.held = nil
+	}
+	for _, l := range s.lanes {
+		for len(l.ch) > 0 {
+			left = append(left, <-l.ch)
+		}
+	}
+	return left
+}
+
+//stats returns queue length and overflow counters of lanes
+func (s *mailbox) stats() map[string]interface{} {
+	lanes := make([]interface{}, 0, len(s.lanes))
+	var overflows, dropped uint64
+	for _, l := range s.lanes {
+		lo := atomic.LoadUint64(&l.overflows)
+		ld := atomic.LoadUint64(&l.dropped)
+		overflows += lo
+		dropped += ld
+		lanes = append(lanes, map[string]interface{}{
+			"priority":  l.Priority,
+			"weight":    l.Weight,
+			"length":    len(l.ch),
+			"capacity":  cap(l.ch),
+			"overflows": lo,
+			"dropped":   ld,
+		})
+	}
+	return map[string]interface{}{
+		"overflow":  s.conf.Overflow,
+		"lanes":     lanes,
+		"overflows": overflows,
+		"dropped":   dropped,
+	}
+}
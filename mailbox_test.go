@@ -0,0 +1,275 @@
+package elsvc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewMailboxConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		lanes        []LaneConfig
+		chanLength   int
+		overflow     string
+		blockTimeout string
+		want         mailboxConfig
+		wantErr      bool
+	}{
+		{name: "defaults", want: mailboxConfig{
+			Lanes:        defaultLanes(defaultChanLength),
+			Overflow:     OverflowReject,
+			BlockTimeout: defaultBlockTimeout,
+		}},
+		{name: "chan length", chanLength: 3, overflow: OverflowBlock, blockTimeout: "20ms", want: mailboxConfig{
+			Lanes:        defaultLanes(3),
+			Overflow:     OverflowBlock,
+			BlockTimeout: 20 * time.Millisecond,
+		}},
+		{name: "lane defaults", chanLength: 5, overflow: OverflowDropOldest,
+			lanes: []LaneConfig{{Priority: 2, Weight: 3, Length: 7}, {Priority: 0}},
+			want: mailboxConfig{
+				Lanes:        []LaneConfig{{Priority: 2, Weight: 3, Length: 7}, {Priority: 0, Weight: 1, Length: 5}},
+				Overflow:     OverflowDropOldest,
+				BlockTimeout: defaultBlockTimeout,
+			}},
+		{name: "negative chan length", chanLength: -1, wantErr: true},
+		{name: "unknown overflow", overflow: "wait", wantErr: true},
+		{name: "invalid block timeout", blockTimeout: "soon", wantErr: true},
+		{name: "zero block timeout", blockTimeout: "0s", wantErr: true},
+		{name: "negative block timeout", blockTimeout: "-1s", wantErr: true},
+		{name: "duplicated lane", lanes: []LaneConfig{{Priority: 1}, {Priority: 1}}, wantErr: true},
+		{name: "negative weight", lanes: []LaneConfig{{Priority: 1, Weight: -1}}, wantErr: true},
+		{name: "negative length", lanes: []LaneConfig{{Priority: 1, Length: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := newMailboxConfig(tt.lanes, tt.chanLength, tt.overflow, tt.blockTimeout)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: newMailboxConfig should fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: newMailboxConfig failed: %v", tt.name, err)
+			continue
+		}
+		if got.Overflow != tt.want.Overflow || got.BlockTimeout != tt.want.BlockTimeout ||
+			len(got.Lanes) != len(tt.want.Lanes) {
+			t.Errorf("%s: newMailboxConfig = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got.Lanes {
+			if got.Lanes[i] != tt.want.Lanes[i] {
+				t.Errorf("%s: lane %d = %+v, want %+v", tt.name, i, got.Lanes[i], tt.want.Lanes[i])
+			}
+		}
+	}
+}
+
+func testMailbox(t *testing.T, lanes []LaneConfig, overflow string, onDrop func(interface{}, error)) *mailbox {
+	conf, err := newMailboxConfig(lanes, 0, overflow, "20ms")
+	if err != nil {
+		t.Fatalf("newMailboxConfig failed: %v", err)
+	}
+	return newMailbox("test", conf, make(chan interface{}), onDrop)
+}
+
+func TestMailboxLane(t *testing.T) {
+	mb := testMailbox(t, nil, "", nil)
+	tests := []struct {
+		priority int
+		want     int
+	}{
+		{priority: PriorityHigh, want: PriorityHigh},
+		{priority: 5, want: PriorityHigh},
+		{priority: PriorityNormal, want: PriorityNormal},
+		{priority: PriorityLow, want: PriorityLow},
+		{priority: -5, want: PriorityLow},
+	}
+	for _, tt := range tests {
+		if got := mb.lane(tt.priority).Priority; got != tt.want {
+			t.Errorf("lane of priority %d = %d, want %d", tt.priority, got, tt.want)
+		}
+	}
+}
+
+func TestMailboxFairness(t *testing.T) {
+	tests := []struct {
+		name  string
+		lanes []LaneConfig
+		fill  []int // priorities with pending msgs
+		picks int
+		want  map[int]int // deliveries by priority
+	}{
+		{name: "default weights", fill: []int{PriorityHigh, PriorityNormal, PriorityLow}, picks: 13,
+			want: map[int]int{PriorityHigh: 8, PriorityNormal: 4, PriorityLow: 1}},
+		{name: "two rounds", fill: []int{PriorityHigh, PriorityNormal, PriorityLow}, picks: 26,
+			want: map[int]int{PriorityHigh: 16, PriorityNormal: 8, PriorityLow: 2}},
+		{name: "idle lane", fill: []int{PriorityHigh, PriorityLow}, picks: 18,
+			want: map[int]int{PriorityHigh: 16, PriorityLow: 2}},
+		{name: "single lane", fill: []int{PriorityLow}, picks: 5,
+			want: map[int]int{PriorityLow: 5}},
+		{name: "equal weights", lanes: []LaneConfig{{Priority: 1, Weight: 1}, {Priority: 0, Weight: 1}},
+			fill: []int{1, 0}, picks: 10, want: map[int]int{1: 5, 0: 5}},
+		{name: "custom weights", lanes: []LaneConfig{{Priority: 1, Weight: 3}, {Priority: 0, Weight: 2}},
+			fill: []int{1, 0}, picks: 10, want: map[int]int{1: 6, 0: 4}},
+	}
+	for _, tt := range tests {
+		mb := testMailbox(t, tt.lanes, "", nil)
+		for _, priority := range tt.fill {
+			l := mb.lane(priority)
+			for len(l.ch) < cap(l.ch) {
+				l.ch <- MsgBase{Priority: priority}
+			}
+		}
+		got := make(map[int]int)
+		lowWait := 0
+		for i := 0; i < tt.picks; i++ {
+			l := mb.next()
+			if l == nil {
+				t.Fatalf("%s: no lane picked with msgs pending", tt.name)
+			}
+			<-l.ch
+			got[l.Priority]++
+			if got[PriorityLow] == 0 {
+				lowWait++
+			}
+		}
+		for priority, n := range tt.want {
+			if got[priority] != n {
+				t.Errorf("%s: lane %d got %d of %d deliveries, want %d", tt.name, priority, got[priority], tt.picks, n)
+			}
+		}
+		// lowest lane is served within a round of weights, never starved
+		if got[PriorityLow] != 0 && lowWait > 13 {
+			t.Errorf("%s: lowest lane waited %d deliveries", tt.name, lowWait)
+		}
+	}
+}
+
+func TestMailboxNextEmpty(t *testing.T) {
+	mb := testMailbox(t, nil, "", nil)
+	if l := mb.next(); l != nil {
+		t.Errorf("next of empty mailbox = lane %d, want nil", l.Priority)
+	}
+}
+
+func TestMailboxOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		wantErr  bool
+		dropped  string // msg passed to onDrop
+		left     string // msg left in lane
+	}{
+		{overflow: OverflowReject, wantErr: true, left: "old"},
+		{overflow: OverflowDropNewest, dropped: "new", left: "old"},
+		{overflow: OverflowDropOldest, dropped: "old", left: "new"},
+		{overflow: OverflowBlock, dropped: "new", left: "old"},
+	}
+	for _, tt := range tests {
+		var dropped []MsgBase
+		var dropErr error
+		mb := testMailbox(t, []LaneConfig{{Priority: 0, Length: 1}}, tt.overflow, func(v interface{}, err error) {
+			dropped = append(dropped, v.(MsgBase))
+			dropErr = err
+		})
+		if err := mb.put(MsgBase{MsgType: "old"}); err != nil {
+			t.Fatalf("%s: put failed: %v", tt.overflow, err)
+		}
+		err := mb.put(MsgBase{MsgType: "new"})
+		if tt.wantErr {
+			merr := AsMsgError(err)
+			if merr == nil || merr.Code != ErrCodeRejected || !merr.Retryable {
+				t.Errorf("%s: put to full lane = %v, want retryable rejection", tt.overflow, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: put to full lane failed: %v", tt.overflow, err)
+		}
+		if tt.dropped == "" && len(dropped) != 0 {
+			t.Errorf("%s: dropped %+v, want none", tt.overflow, dropped)
+		}
+		if tt.dropped != "" && (len(dropped) != 1 || dropped[0].MsgType != tt.dropped || dropErr == nil) {
+			t.Errorf("%s: dropped %+v with %v, want %s", tt.overflow, dropped, dropErr, tt.dropped)
+		}
+		l := mb.lane(0)
+		if len(l.ch) != 1 {
+			t.Fatalf("%s: lane has %d msgs, want 1", tt.overflow, len(l.ch))
+		}
+		if left := (<-l.ch).(MsgBase); left.MsgType != tt.left {
+			t.Errorf("%s: lane has %s, want %s", tt.overflow, left.MsgType, tt.left)
+		}
+		stats := mb.stats()
+		if stats["overflows"] != uint64(1) || stats["dropped"] != uint64(1) {
+			t.Errorf("%s: stats = %+v, want 1 overflow and 1 dropped", tt.overflow, stats)
+		}
+	}
+}
+
+func TestMailboxRun(t *testing.T) {
+	out := make(chan interface{})
+	conf, err := newMailboxConfig(nil, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := newMailbox("test", conf, out, nil)
+	for _, priority := range []int{PriorityLow, PriorityNormal, PriorityHigh} {
+		if err := mb.put(MsgBase{Priority: priority}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if n := mb.pending(); n != 3 {
+		t.Errorf("pending = %d, want 3", n)
+	}
+	go mb.run()
+	for _, want := range []int{PriorityHigh, PriorityNormal, PriorityLow} {
+		select {
+		case v := <-out:
+			if got := v.(MsgBase).Priority; got != want {
+				t.Errorf("delivered msg of priority %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("msg isn't delivered")
+		}
+	}
+	// msgs put later are delivered too
+	if err := mb.put(MsgBase{MsgType: "later"}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	select {
+	case v := <-out:
+		if v.(MsgBase).MsgType != "later" {
+			t.Errorf("delivered %+v, want later", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("msg put later isn't delivered")
+	}
+	mb.close()
+}
+
+func TestMailboxDrain(t *testing.T) {
+	mb := testMailbox(t, nil, "", nil)
+	for _, priority := range []int{PriorityLow, PriorityHigh} {
+		if err := mb.put(MsgBase{Priority: priority}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	go mb.run()
+	// out is never read, run holds the high msg
+	deadline := time.Now().Add(time.Second)
+	for mb.pending() != 2 || len(mb.lane(PriorityHigh).ch) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("run didn't take the high msg")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mb.close()
+	// closed mailbox rejects msgs even if lanes have room
+	err := mb.put(MsgBase{Priority: PriorityHigh})
+	if merr := AsMsgError(err); merr == nil || merr.Code != ErrCodeUnavailable {
+		t.Errorf("put to closed mailbox = %v, want unavailable", err)
+	}
+	left := mb.drain()
+	if len(left) != 2 || left[0].(MsgBase).Priority != PriorityHigh || left[1].(MsgBase).Priority != PriorityLow {
+		t.Errorf("drain = %+v, want the held high msg and the low msg", left)
+	}
+}
@@ -1,14 +1,22 @@
 package elsvc
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	fmt "fmt"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	CtxKeyConfig  = "config"
 	CtxKeyInchan  = "in_chan"
 	CtxKeyOutchan = "out_chan"
+	CtxKeyName    = "plugin_name"
+	CtxKeyParent  = "parent_msg"
+	CtxKeyStartID = "start_id" // id of the Start call of plugin, sent back in MsgStartError
 )
 
 const (
@@ -17,20 +25,84 @@ const (
 )
 
 type MsgBase struct {
-	MsgId       string
-	MsgFrom     string
-	MsgTo       string
-	MsgType     string
-	MsgRequest  map[string]interface{}
-	MsgResponse chan map[string]interface{}
-	response    map[string]interface{} // store response for multiple
-	TTL         int64
+	MsgId         string
+	CorrelationId string // id of the root msg of a request tree
+	CausationId   string // id of the msg which causes this msg
+	MsgFrom       string
+	MsgTo         string
+	MsgType       string
+	MsgRequest    map[string]interface{}
+	MsgResponse   chan map[string]interface{}
+	response      map[string]interface{} // store response for multiple
+	TTL           int64
+	Deadline      time.Time         // zero means no deadline
+	WantReply     bool              // sender is waiting for response
+	Priority      int               // lane of msg in plugin in-chan, see PriorityHigh
+	Headers       map[string]string // annotations, e.g. added by interceptors
+}
+
+var msgSeq uint64
+
+//newMsgID returns a random unique msg id
+func newMsgID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// fallback to time and sequence if random source fails
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&msgSeq, 1))
+	}
+	return hex.EncodeToString(b)
 }
 
 func (s MsgBase) ID() string {
 	return s.MsgId
 }
 
+func (s MsgBase) Correlation() string {
+	return s.CorrelationId
+}
+
+func (s MsgBase) Causation() string {
+	return s.CausationId
+}
+
+//Derive create a new msg caused by this msg, it inherits the correlation id
+func (s MsgBase) Derive(msgTo, msgType string) MsgBase {
+	msg := NewMsg(msgTo, msgType)
+	msg.inherit(s)
+	return msg
+}
+
+//inherit make msg a child of parent
+func (s *MsgBase) inherit(parent MsgBase) {
+	s.CausationId = parent.ID()
+	s.CorrelationId = parent.Correlation()
+	if s.CorrelationId == "" {
+		s.CorrelationId = parent.ID()
+	}
+}
+
+//isRoot reports whether msg isn't derived from another msg
+func (s MsgBase) isRoot() bool {
+	return s.CausationId == "" && s.CorrelationId == s.MsgId
+}
+
+func (s MsgBase) String() string {
+	return fmt.Sprintf("{id:%s correlation:%s causation:%s from:%s to:%s type:%s ttl:%d request:%v}",
+		s.MsgId, s.CorrelationId, s.CausationId, s.MsgFrom, s.MsgTo, s.MsgType, s.TTL, s.MsgRequest)
+}
+
+//Header returns value of header key, empty if not set
+func (s MsgBase) Header(key string) string {
+	return s.Headers[key]
+}
+
+func (s *MsgBase) SetHeader(key, value string) {
+	if s.Headers == nil {
+		s.Headers = make(map[string]string)
+	}
+	s.Headers[key] = value
+}
+
 func (s MsgBase) From() string {
 	return s.MsgFrom
 }
@@ -44,43 +116,17 @@ func (s MsgBase) Type() string {
 }
 
 func (s MsgBase) GetRequest() map[string]interface{} {
-	req := s.MsgRequest
-	// tricky to handle two types of plugins
-	for k, v := range req {
-		switch k {
-		// handle error message
-		case "error":
-			switch errStr := v.(type) {
-			case string:
-				if errStr == "" {
-					req["error"] = nil
-				} else {
-					req["error"] = fmt.Errorf(errStr)
-				}
-			}
-		}
-	}
+	decodeErrors(s.MsgRequest)
 	return s.MsgRequest
 }
 
+//GetRequestError returns the error in request, e.g. error of MsgStartError
+func (s MsgBase) GetRequestError() error {
+	return errorValue(s.GetRequest()["error"])
+}
+
 func (s MsgBase) GetRequestBytes() []byte {
-	req := s.MsgRequest
-	// tricky to handle two types of plugins
-	for k, v := range req {
-		switch k {
-		// handle error message
-		case "error":
-			switch v.(type) {
-			case nil:
-				req["error"] = ""
-			// convert to error
-			case error:
-				err := v.(error)
-				req["error"] = err.Error()
-			}
-		}
-	}
-	data, _ := json.Marshal(req)
+	data, _ := json.Marshal(encodedCopy(s.MsgRequest))
 	return data
 }
 
@@ -99,58 +145,40 @@ func (s *MsgBase) SetRequest(req map[string]interface{}) error {
 }
 
 func (s *MsgBase) SetRequestBytes(data []byte) error {
-	if len(data) == 0 {
-		return s.SetRequest(nil)
-	}
-	req := make(map[string]interface{})
-	err := json.Unmarshal(data, &req)
+	req, err := unmarshalPayload(data)
 	if err != nil {
 		return err
 	}
-	// tricky to handle two types of plugins
-	for k, v := range req {
-		switch k {
-		// handle error message
-		case "error":
-			switch v.(type) {
-			// convert to error
-			case string:
-				errStr := v.(string)
-				if errStr == "" {
-					req["error"] = nil
-				} else {
-					req["error"] = fmt.Errorf(errStr)
-				}
-			}
-		}
-	}
 	return s.SetRequest(req)
 }
 
-//GetResponse get response
+//GetResponse get response, it blocks until response is set
 func (s *MsgBase) GetResponse() map[string]interface{} {
+	resp, _ := s.GetResponseContext(context.Background())
+	return resp
+}
+
+//GetResponseContext get response, it returns a timeout MsgError if ctx is done
+//before response is set
+func (s *MsgBase) GetResponseContext(ctx context.Context) (map[string]interface{}, error) {
 	if s.response != nil {
 		// if GetResponse() called before
-		return s.response
-	}
-	resp := <-s.MsgResponse
-	// tricky to handle two types of plugins
-	for k, v := range resp {
-		switch k {
-		// handle error message
-		case "error":
-			switch errStr := v.(type) {
-			case string:
-				if errStr == "" {
-					resp["error"] = nil
-				} else {
-					resp["error"] = fmt.Errorf(errStr)
-				}
-			}
+		return s.response, nil
+	}
+	var resp map[string]interface{}
+	select {
+	case resp = <-s.MsgResponse:
+	case <-ctx.Done():
+		// response may arrive at the same time
+		select {
+		case resp = <-s.MsgResponse:
+		default:
+			return nil, newTimeoutError(*s, ctx.Err())
 		}
 	}
+	decodeErrors(resp)
 	s.response = resp
-	return resp
+	return resp, nil
 }
 
 func (s *MsgBase) GetResponseBytes() []byte {
@@ -160,21 +188,7 @@ func (s *MsgBase) GetResponseBytes() []byte {
 		// it should never be called
 		return []byte("")
 	}
-	// tricky to handle two types of plugins
-	for k, v := range resp {
-		switch k {
-		// handle error message
-		case "error":
-			switch v.(type) {
-			case nil:
-				resp["error"] = ""
-			// convert to error
-			case error:
-				err := v.(error)
-				resp["error"] = err.Error()
-			}
-		}
-	}
+	encodeErrors(resp)
 	data, _ := json.Marshal(resp)
 	return data
 }
@@ -182,64 +196,73 @@ func (s *MsgBase) GetResponseBytes() []byte {
 func (s *MsgBase) SetResponse(resp map[string]interface{}) error {
 	s.response = nil
 	if resp == nil {
-		s.MsgResponse <- make(map[string]interface{})
+		resp = make(map[string]interface{})
+	}
+	// never block the responder, the slot is full if response is set already
+	// or nobody waits for it anymore
+	select {
+	case s.MsgResponse <- resp:
 		return nil
+	default:
+		return fmt.Errorf("failed to set response for msg %s: reply slot is not available", s.Type())
 	}
-	s.MsgResponse <- resp
-	return nil
 }
 
 func (s *MsgBase) SetResponseBytes(data []byte) error {
 	s.response = nil
-	if len(data) == 0 {
-		return s.SetResponse(nil)
-	}
-	resp := make(map[string]interface{})
-	err := json.Unmarshal(data, &resp)
+	resp, err := unmarshalPayload(data)
 	if err != nil {
 		return err
 	}
-	// tricky to handle two types of plugins
-	for k, v := range resp {
-		switch k {
-		// handle error message
-		case "error":
-			switch v.(type) {
-			// convert to error
-			case string:
-				errStr := v.(string)
-				if errStr == "" {
-					resp["error"] = nil
-				} else {
-					resp["error"] = fmt.Errorf(errStr)
-				}
-			}
-		}
-	}
 	return s.SetResponse(resp)
 }
 
+//unmarshalPayload decode json payload, error in it is decoded as MsgError
+func unmarshalPayload(data []byte) (map[string]interface{}, error) {
+	payload := make(map[string]interface{})
+	if len(data) == 0 {
+		return payload, nil
+	}
+	err := json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, err
+	}
+	decodeErrors(payload)
+	return payload, nil
+}
+
 func (s *MsgBase) SetError(err error) {
 	s.SetResponse(map[string]interface{}{"error": err})
 }
 
+//GetError returns the error in response, it's a MsgError if not nil
 func (s *MsgBase) GetError() error {
-	resp := s.GetResponse()
-	if v, ok := resp["error"]; ok {
-		switch v.(type) {
-		case nil:
-			return nil
-		case error:
-			return v.(error)
-		}
+	err := errorValue(s.GetResponse()["error"])
+	if err == nil {
+		return nil
 	}
-	return nil
+	return AsMsgError(err)
 }
 
-// func (s *MsgBase) Expired() bool {
-// 	return s.TTL <= 0
-// }
+//DeadlineExceeded reports whether deadline of msg passed
+func (s MsgBase) DeadlineExceeded() bool {
+	return !s.Deadline.IsZero() && time.Now().After(s.Deadline)
+}
+
+//msgContext returns a ctx which is done at the deadline of msg
+func msgContext(ctx context.Context, msg MsgBase) (context.Context, context.CancelFunc) {
+	if msg.Deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, msg.Deadline)
+}
 
-// func (s *MsgBase) DeTTL() {
-// 	s.TTL--
-// }
+//Expired reports whether msg runs out of its TTL
+func (s *MsgBase) Expired() bool {
+	return s.TTL <= 0
+}
+
+//DeTTL decrease TTL of msg, it's called on every routing attempt
+func (s *MsgBase) DeTTL() {
+	s.TTL--
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"plugin"
-	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -18,18 +18,40 @@ const (
 	FuncStop  = "Stop"
 )
 
+//Symbols looked up in goplugin
+const (
+	SymbolPluginObj = "PluginObj"
+	// func() elsvc.PluginIntf, creates objects for named instances of plugin
+	SymbolNewPlugin = "NewPlugin"
+)
+
+//symbolLookup is an opened goplugin, see plugin.Plugin
+type symbolLookup interface {
+	Lookup(symName string) (plugin.Symbol, error)
+}
+
+//openGoplugin opens goplugin at path, tests replace it to load plugins in process
+var openGoplugin = func(path string) (symbolLookup, error) {
+	return plugin.Open(path)
+}
+
 type PluginLoaderIntf interface {
 	Name() string
 	Load(PluginConfig) error
 	Init(ctx context.Context) error
 	Start(ctx context.Context) error
 	Stop(ctx context.Context) error
+	Meta() *PluginMeta // nil if plugin isn't a PluginInfo
 }
 
 type pluginLoader struct {
-	goplugin   *plugin.Plugin
+	goplugin   symbolLookup
 	elplugin   PluginIntf
+	meta       *PluginMeta
+	verifier   *verifier
+	name       string // instance name
 	pluginPath string
+	started    chan struct{} // closed when Start returns
 	logger     *Logger
 }
 
@@ -38,45 +60,86 @@ type pluginLoader struct {
 // }
 
 func (s pluginLoader) Name() string {
-	return s.elplugin.ModuleName()
+	return s.name
 }
 
 func (s *pluginLoader) Load(pc PluginConfig) error {
 	s.logger = NewModLogger("pluginLoader")
 
-	pluginPath := findLatestSO(pc.Type, pc.PluginPath())
-	if pluginPath == "" {
-		return fmt.Errorf("failed to find plugin for %s", pc.Type)
+	pluginPath, err := pc.findSO()
+	if err != nil {
+		return err
 	}
-	p, err := plugin.Open(pluginPath)
+	openPath, err := s.verifier.verify(pc, pluginPath)
 	if err != nil {
 		return err
 	}
-	symbol, err := p.Lookup("PluginObj")
+	p, err := openGoplugin(openPath)
 	if err != nil {
-		return errors.Wrapf(err, "failed to find PluginObj in %s", pluginPath)
+		return err
 	}
-	elp, ok := symbol.(PluginIntf)
-	if !ok {
-		return fmt.Errorf("failed to convert PluginObj in %s", pluginPath)
+	elp, err := lookupPlugin(p, pluginPath, pc.InstanceName() != pc.Type)
+	if err != nil {
+		return err
+	}
+	// make sure ModuleName is equal with type parsed in
+	if elp.ModuleName() != pc.Type {
+		return fmt.Errorf("ModuleName %s != plugin type %s", elp.ModuleName(), pc.Type)
+	}
+	if pi, ok := elp.(PluginInfo); ok {
+		meta := pi.Info()
+		s.meta = &meta
+	}
+	err = checkAPIVersion(pc.InstanceName(), s.meta)
+	if err != nil {
+		return err
 	}
-	// Set env
+	// Set env, it's shared by all plugins, named instances can't set it
 	for k, v := range pc.EnvMap {
 		os.Setenv(k, v)
 	}
 	s.elplugin = elp
+	s.name = pc.InstanceName()
 	s.goplugin = p
 	s.pluginPath = pluginPath
 	return nil
 }
 
+//lookupPlugin returns PluginObj of p, or a new object created by NewPlugin for
+//a named instance as PluginObj is shared by all loaders of p
+func lookupPlugin(p symbolLookup, pluginPath string, named bool) (PluginIntf, error) {
+	if !named {
+		symbol, err := p.Lookup(SymbolPluginObj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find %s in %s", SymbolPluginObj, pluginPath)
+		}
+		elp, ok := symbol.(PluginIntf)
+		if !ok {
+			return nil, fmt.Errorf("failed to convert %s in %s", SymbolPluginObj, pluginPath)
+		}
+		return elp, nil
+	}
+	symbol, err := p.Lookup(SymbolNewPlugin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find %s in %s for named instance", SymbolNewPlugin, pluginPath)
+	}
+	newPlugin, ok := symbol.(func() PluginIntf)
+	if !ok {
+		return nil, fmt.Errorf("%s in %s isn't func() PluginIntf", SymbolNewPlugin, pluginPath)
+	}
+	return newPlugin(), nil
+}
+
 func (s *pluginLoader) Init(ctx context.Context) error {
 	return s.elplugin.Init(ctx)
 }
 
 func (s *pluginLoader) Start(ctx context.Context) error {
+	started := make(chan struct{})
+	s.started = started
 	go func() {
 		err := s.elplugin.Start(ctx)
+		close(started)
 		if err != nil {
 			s.logger.Error("plugin %s error from start: %s", s.pluginPath, err.Error())
 		}
@@ -84,62 +147,129 @@ func (s *pluginLoader) Start(ctx context.Context) error {
 		// return start() error to Service
 		msg := NewMsg(ChanKeyService, MsgStartError)
 		msg.SetResponse(map[string]interface{}{
-			"plugin": s.Name(),
-			"error":  err,
+			"plugin":   s.Name(),
+			"start_id": ctx.Value(CtxKeyStartID),
+			"error":    err,
 		})
 		SendMsg(ctx, msg)
 	}()
 	return nil
 }
 
+func (s *pluginLoader) Meta() *PluginMeta {
+	return s.meta
+}
+
+//Health probe plugin if it's a HealthChecker
+func (s *pluginLoader) Health(ctx context.Context) error {
+	hc, ok := s.elplugin.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	return hc.Health(ctx)
+}
+
+//Reconfigure apply new config in ctx to plugin, it fails with
+//ErrCodeNotFound if plugin isn't a Reconfigurer
+func (s *pluginLoader) Reconfigure(ctx context.Context) error {
+	rc, ok := s.elplugin.(Reconfigurer)
+	if !ok {
+		return NewError(ErrCodeNotFound, "plugin %s can't be reconfigured", s.Name())
+	}
+	return rc.Reconfigure(ctx)
+}
+
+//Stop plugin and wait for its Start to return until ctx is done
 func (s *pluginLoader) Stop(ctx context.Context) error {
-	return s.elplugin.Stop(ctx)
+	err := s.elplugin.Stop(ctx)
+	if err != nil {
+		return err
+	}
+	if s.started == nil {
+		return nil
+	}
+	select {
+	case <-s.started:
+		return nil
+	case <-ctx.Done():
+		return NewError(ErrCodeTimeout, "Start of plugin %s didn't return", s.Name()).WithCause(ctx.Err())
+	}
+}
+
+//soCandidate is a binary of plugin found in plugin_path, and why it's rejected
+type soCandidate struct {
+	File     string `json:"file"`
+	Rejected string `json:"rejected,omitempty"`
 }
 
-//FindLatestSO find the latest so under pluginPath
-// so file must format as: <plugin_name>.so.<int version>
-// returns: fullPluginPath
-func findLatestSO(pluginName string, pluginPath string) string {
+//FindLatestSO find the latest so under pluginPath matching constraint
+// so file must format as: <plugin_name>.so.<semver>, or <plugin_name>.so
+// returns: fullPluginPath, and the candidates rejected
+func findLatestSO(pluginName string, pluginPath string, constraint *versionConstraint) (string, []soCandidate) {
+	filePrefix := fmt.Sprintf("%s.so", pluginName)
 	// if plugin_path is a so file e.g. "./<plugin>.so"
 	if isFile(pluginPath) {
-		return pluginPath
+		if !constraint.pinned() {
+			return pluginPath, nil
+		}
+		name := filepath.Base(pluginPath)
+		if _, reason := matchSO(name, filePrefix, constraint); reason != "" {
+			return "", []soCandidate{{File: name, Rejected: reason}}
+		}
+		return pluginPath, nil
 	}
 	// if plugin_path is a so dir e.g. "./"
 	files, err := ioutil.ReadDir(pluginPath)
 	if err != nil {
-		return ""
+		return "", nil
 	}
-	filePrefix := fmt.Sprintf("%s.so", pluginName)
 	pluginFile := ""
-	version := -1
+	var version *semver
+	rejected := make([]soCandidate, 0)
 	for _, f := range files {
 		name := f.Name()
-		if !strings.HasPrefix(name, filePrefix) {
+		if isSidecar(name) || (name != filePrefix && !strings.HasPrefix(name, filePrefix+".")) {
+			continue
+		}
+		ver, reason := matchSO(name, filePrefix, constraint)
+		if reason != "" {
+			rejected = append(rejected, soCandidate{File: name, Rejected: reason})
 			continue
 		}
-		splitN := strings.Split(name, ".")
-		switch len(splitN) {
-		case 2:
+		if ver == nil {
 			// <plugin>.so
 			if pluginFile == "" {
 				pluginFile = name
 			}
-		case 3:
-			// <plugin>.so.<version>
-			versionStr := splitN[2]
-			ver, err := strconv.Atoi(versionStr)
-			if err != nil {
-				// invalid version
-				continue
-			}
-			if ver > version {
-				version = ver
-				pluginFile = name
-			}
+			continue
+		}
+		if version == nil || ver.compare(version) > 0 {
+			version = ver
+			pluginFile = name
 		}
 	}
 	if pluginFile == "" {
-		return ""
+		return "", rejected
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimRight(pluginPath, "/"), pluginFile), rejected
+}
+
+//matchSO check version in name of so file against constraint, returns
+//its version, nil for <plugin>.so, or why it's rejected
+func matchSO(name string, filePrefix string, constraint *versionConstraint) (*semver, string) {
+	if !strings.HasPrefix(name, filePrefix+".") {
+		if constraint.pinned() {
+			return nil, "no version"
+		}
+		return nil, ""
+	}
+	// <plugin>.so.<version>
+	ver, err := parseSemver(strings.TrimPrefix(name, filePrefix+"."))
+	if err != nil {
+		return nil, err.Error()
+	}
+	if ok, reason := constraint.match(ver); !ok {
+		return nil, reason
 	}
-	return fmt.Sprintf("%s/%s", strings.TrimRight(pluginPath, "/"), pluginFile)
+	return ver, ""
 }
@@ -2,8 +2,10 @@ package elsvc
 
 import (
 	context "context"
+	"encoding/json"
 	fmt "fmt"
 	"os/exec"
+	"sync"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/lynic/elsvc/proto"
@@ -13,70 +15,145 @@ import (
 const PluginMapKey = "elplugin"
 
 type pluginRunner struct {
-	PluginName   string
+	PluginName   string // instance name
 	svcClient    proto.PluginSvcClient
 	broker       *plugin.GRPCBroker
 	chanRPC      *grpc.Server
 	pluginClient *plugin.Client
+	conn         *grpc.ClientConn // conn to plugin process, watched for failures
+	cmd          *exec.Cmd
 	binaryPath   string
 	logger       *Logger
 	recvChan     chan interface{} // receive msg from pluginserver
-	// pluginConfig PluginConfig
+	mailboxConf  mailboxConfig    // in-chan config in plugin process
+	startID      string           // id of Start, see CtxKeyStartID
+	pluginConfig PluginConfig
+	meta         *PluginMeta
+	verifier     *verifier
+	// config passed to Init, sent again on respawn
+	initConf map[string]interface{}
+	stderr   *stderrTail   // last stderr lines of plugin process
+	crashed  chan struct{} // signaled by watch when plugin process exits
+	mut      sync.Mutex    // guards plugin process swapped by respawn
+	stopping bool
+	drains   chan chan struct{} // closed by chanHandler, see drain
+	inflight sync.WaitGroup     // msgs forwarded waiting for their replies
 }
 
 func (s *pluginRunner) Load(pc PluginConfig) error {
-	s.logger = NewModLogger(fmt.Sprintf("pluginRunner.%s", pc.Type))
-	// s.pluginConfig = pc
+	s.logger = NewModLogger(fmt.Sprintf("pluginRunner.%s", pc.InstanceName()))
+	s.PluginName = pc.InstanceName()
+	s.pluginConfig = pc
 	//find binary
-	binaryPath := findLatestSO(pc.Type, pc.PluginPath())
-	if binaryPath == "" {
-		return fmt.Errorf("couldn't find plugin binary for %s", pc.Type)
+	binaryPath, err := pc.findSO()
+	if err != nil {
+		return err
 	}
 	s.binaryPath = binaryPath
+	mbConf, err := pc.mailboxConfig()
+	if err != nil {
+		return err
+	}
+	s.mailboxConf = mbConf
+	s.recvChan = make(chan interface{}, defaultChanLength)
+	s.crashed = make(chan struct{}, 1)
+	s.drains = make(chan chan struct{})
+	err = s.launch()
+	if err != nil {
+		return err
+	}
+	// make sure ModuleName is equal with type parsed in
+	moduleName, err := s.moduleName()
+	if err != nil {
+		s.pluginClient.Kill()
+		return err
+	}
+	if moduleName != pc.Type {
+		s.pluginClient.Kill()
+		return fmt.Errorf("ModuleName %s != plugin type %s", moduleName, pc.Type)
+	}
+	s.meta, err = s.info()
+	if err == nil {
+		err = checkAPIVersion(pc.InstanceName(), s.meta)
+	}
+	if err != nil {
+		s.pluginClient.Kill()
+		return err
+	}
+	return nil
+}
 
+//launch run plugin binary and connect to it, the new process replaces
+//the current one unless runner is stopped meanwhile
+func (s *pluginRunner) launch() error {
+	pc := s.pluginConfig
 	//load plugin
 	pluginMap := map[string]plugin.Plugin{
 		PluginMapKey: &GRPCPlugin{},
 	}
 
+	// binary may be replaced before it's respawned
+	execPath, err := s.verifier.verify(pc, s.binaryPath)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(execPath)
+	stderr := newStderrTail(stderrTailLines)
 	client := plugin.NewClient(&plugin.ClientConfig{
 		HandshakeConfig:  HandshakeConf(),
 		Plugins:          pluginMap,
-		Cmd:              exec.Command(binaryPath),
+		Cmd:              cmd,
 		Logger:           NewModLogger("hcplugin").hclogger,
+		Stderr:           stderr,
 		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
 	})
-	s.pluginClient = client
 
 	// Connect via RPC
 	rpcClient, err := client.Client()
 	if err != nil {
 		s.logger.Error("failed to get rpcClient: %v", err)
+		client.Kill()
 		return err
 	}
 	// Request the plugin
 	raw, err := rpcClient.Dispense(PluginMapKey)
 	if err != nil {
 		s.logger.Error("failed to request the plugin: %v", err)
+		client.Kill()
 		return err
 	}
 	pluginClient := raw.(PluginClient)
-	s.svcClient = pluginClient.client
-	s.broker = pluginClient.broker
-	s.recvChan = make(chan interface{}, defaultChanLength)
 	// s.logger = NewModLogger(fmt.Sprintf("pluginRunner.%s", s.Name()))
 	// set env
 	for k, v := range pc.EnvMap {
-		err := s.SetEnv(k, v)
+		err := setEnv(pluginClient.client, k, v)
 		if err != nil {
 			s.logger.Error("failed to setenv '%s: %s': %v", k, v, err)
+			client.Kill()
 			return err
 		}
 	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.stopping {
+		client.Kill()
+		return errRunnerStopped
+	}
+	s.cmd = cmd
+	s.stderr = stderr
+	s.pluginClient = client
+	s.svcClient = pluginClient.client
+	s.broker = pluginClient.broker
+	s.conn = pluginClient.conn
 	return nil
 }
 
-func (s pluginRunner) SetEnv(key, value string) error {
+func (s *pluginRunner) SetEnv(key, value string) error {
+	return setEnv(s.client(), key, value)
+}
+
+//setEnv set env of plugin process behind client
+func setEnv(client proto.PluginSvcClient, key, value string) error {
 	msg := NewMsg("", MsgSetEnv)
 	msg.SetRequest(map[string]interface{}{
 		"key":   key,
@@ -86,7 +163,7 @@ func (s pluginRunner) SetEnv(key, value string) error {
 	if err != nil {
 		return err
 	}
-	resp, err := s.svcClient.Request(context.Background(), req)
+	resp, err := client.Request(context.Background(), req)
 	if err != nil {
 		return err
 	}
@@ -94,55 +171,138 @@ func (s pluginRunner) SetEnv(key, value string) error {
 	if err != nil {
 		return err
 	}
-	if v, ok := rmsg.GetResponse()["error"]; ok && v != nil {
-		return v.(error)
-	}
-	return nil
+	return rmsg.GetError()
 }
 
 func (s *pluginRunner) Name() string {
-	if s.PluginName != "" {
-		return s.PluginName
-	}
+	return s.PluginName
+}
+
+//moduleName returns ModuleName of plugin in the process
+func (s *pluginRunner) moduleName() (string, error) {
 	msg := NewMsg("", MsgFuncName)
 	req, err := msgReq(msg)
 	if err != nil {
-		return ""
+		return "", err
 	}
 	resp, err := s.svcClient.Request(context.Background(), req)
 	if err != nil {
-		return ""
+		return "", err
 	}
 	rmsg, _ := respMsg(resp)
-	s.PluginName = rmsg.GetResponse()["name"].(string)
-	return s.PluginName
+	name, _ := rmsg.GetResponse()["name"].(string)
+	return name, nil
+}
+
+//info returns metadata of plugin, nil if plugin isn't a PluginInfo, or it doesn't
+//answer in time, e.g. it's built before func_info
+func (s *pluginRunner) info() (*PluginMeta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), infoTimeout)
+	defer cancel()
+	msg := NewMsg(s.Name(), MsgFuncInfo)
+	req, err := msgReq(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.svcClient.Request(ctx, req)
+	if err != nil {
+		s.logger.Info("plugin %s has no info: %v", s.Name(), err)
+		return nil, nil
+	}
+	rmsg, _ := respMsg(resp)
+	reply, err := rmsg.GetResponseContext(ctx)
+	if err != nil {
+		s.logger.Info("plugin %s has no info: %v", s.Name(), err)
+		return nil, nil
+	}
+	info, ok := reply["info"]
+	if !ok {
+		return nil, nil
+	}
+	data, _ := json.Marshal(info)
+	meta := &PluginMeta{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid info of plugin %s: %v", s.Name(), err)
+	}
+	return meta, nil
+}
+
+func (s *pluginRunner) Meta() *PluginMeta {
+	return s.meta
+}
+
+//origin is where msgs dropped by runner come from
+func (s *pluginRunner) origin() string {
+	return fmt.Sprintf("pluginRunner.%s", s.Name())
 }
 
 func (s *pluginRunner) Init(ctx context.Context) error {
-	conf := GetConfig(ctx)
+	s.initConf = GetConfig(ctx)
+	return s.init()
+}
+
+func (s *pluginRunner) init() error {
 	msg := NewMsg(s.Name(), MsgFuncInit)
-	msg.SetRequest(conf)
+	msg.SetRequest(s.initConf)
 	req, err := msgReq(msg)
 	if err != nil {
 		return err
 	}
-	resp, err := s.svcClient.Request(context.Background(), req)
+	resp, err := s.client().Request(context.Background(), req)
 	if err != nil {
 		return err
 	}
 	rmsg, _ := respMsg(resp)
-	errInt := rmsg.GetResponse()["error"]
-	if errInt != nil {
-		return errInt.(error)
+	return rmsg.GetError()
+}
+
+//Reconfigure apply new config in ctx to plugin process,
+//the process is inited with it if it's respawned
+func (s *pluginRunner) Reconfigure(ctx context.Context) error {
+	conf := GetConfig(ctx)
+	msg := NewMsg(s.Name(), MsgFuncConfig)
+	msg.SetRequest(conf)
+	req, err := msgReq(msg)
+	if err != nil {
+		return err
 	}
+	resp, err := s.client().Request(ctx, req)
+	if err != nil {
+		return rpcError(msg, err)
+	}
+	rmsg, _ := respMsg(resp)
+	err = rmsg.GetError()
+	if err != nil {
+		return err
+	}
+	s.initConf = conf
 	return nil
 }
 
+//Health probe plugin process, it fails if the process is unreachable
+func (s *pluginRunner) Health(ctx context.Context) error {
+	msg := NewMsg(s.Name(), MsgFuncHealth)
+	req, err := msgReq(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client().Request(ctx, req)
+	if err != nil {
+		return rpcError(msg, err)
+	}
+	rmsg, _ := respMsg(resp)
+	return rmsg.GetError()
+}
+
 //receiver Func
 func (s *pluginRunner) serverFunc(opts []grpc.ServerOption) *grpc.Server {
-	s.chanRPC = grpc.NewServer(opts...)
-	proto.RegisterPluginSvcServer(s.chanRPC, s)
-	return s.chanRPC
+	server := grpc.NewServer(opts...)
+	proto.RegisterPluginSvcServer(server, s)
+	s.mut.Lock()
+	s.chanRPC = server
+	s.mut.Unlock()
+	return server
 }
 
 //Receive msg from pluginserver, and send to recvChan for further use
@@ -155,8 +315,9 @@ func (s *pluginRunner) Request(ctx context.Context, req *proto.MsgRequest) (*pro
 			s.logger.Error("failed to convert req %+v: %v", req, err)
 		}
 		msg.SetResponse(map[string]interface{}{
-			"plugin": s.Name(),
-			"error":  msg.GetRequest()["error"].(error),
+			"plugin":   s.Name(),
+			"start_id": s.startID,
+			"error":    msg.GetRequestError(),
 		})
 		s.recvChan <- msg
 	default:
@@ -166,35 +327,93 @@ func (s *pluginRunner) Request(ctx context.Context, req *proto.MsgRequest) (*pro
 		}
 		// SendMsg(s.ctx, msg)
 		s.recvChan <- msg
+		if msg.WantReply {
+			// hold the rpc until response arrives or caller gives up
+			_, err := msg.GetResponseContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return msgResp(msg)
+		}
 	}
 	return &proto.MsgResponse{}, nil
 }
 
 //Receive msg from chan and send to plugin
 func (s *pluginRunner) chanHandler(ctx context.Context) error {
+	// msgs received while plugin process is down, replayed after respawn
+	pending := make([]MsgBase, 0)
+	down := false
+	dead := false
+	// result of the respawn running in background, nil if there's none
+	var respawned chan bool
 	for {
 		select {
 		case <-ctx.Done():
 			msg := NewMsg(s.Name(), MsgCtxDone)
 			req, _ := msgReq(msg)
-			_, err := s.svcClient.Request(context.Background(), req)
+			_, err := s.client().Request(context.Background(), req)
 			if err != nil {
 				s.logger.Error("failed to send %v for plugin %s", req, s.Name())
 			}
 			return nil
+		case <-s.crashed:
+			if dead || respawned != nil {
+				continue
+			}
+			down = true
+			// msgs are held meanwhile, respawn may wait for its backoff
+			respawned = make(chan bool, 1)
+			go func(result chan bool) {
+				result <- s.respawn(ctx)
+			}(respawned)
+		case ok := <-respawned:
+			respawned = nil
+			if !ok {
+				dead = true
+				for _, msg := range pending {
+					s.sendDead(ctx, msg)
+				}
+				pending = pending[:0]
+				continue
+			}
+			down = false
+			s.logger.Info("replaying %d msgs for plugin %s", len(pending), s.Name())
+			replay := pending
+			pending = make([]MsgBase, 0)
+			for _, msg := range replay {
+				if down {
+					pending = append(pending, msg)
+					continue
+				}
+				down = !s.forward(ctx, msg)
+			}
+		case done := <-s.drains:
+			// msgs taken before are forwarded
+			close(done)
 		case v := <-InChan(ctx):
 			s.logger.Debug("Recv msg from inChan: %+v", v)
 			// handle message to send to pluginserver
 			msg, ok := v.(MsgBase)
 			if !ok {
 				s.logger.Error("failed to convert req: %+v", v)
+				SendMsg(ctx, newDeadLetterMsg(v, s.origin(), "invalid msg"))
 				continue
 			}
-			req, _ := msgReq(msg)
-			_, err := s.svcClient.Request(context.Background(), req)
-			if err != nil {
-				s.logger.Error("failed to send msg to pluginserver: %v", err)
+			if dead {
+				s.sendDead(ctx, msg)
+				continue
+			}
+			if !down && s.exited() {
+				down = true
+				s.notifyCrash()
 			}
+			if down {
+				s.logger.Debug("plugin process of %s is down, hold msg %s", s.Name(), msg.ID())
+				pending = append(pending, msg)
+				continue
+			}
+			down = !s.forward(ctx, msg)
 		case v := <-s.recvChan:
 			// handler message from pluginserver
 			// MsgStartError is for pluginrunner
@@ -202,11 +421,12 @@ func (s *pluginRunner) chanHandler(ctx context.Context) error {
 			msg, ok := v.(MsgBase)
 			if !ok {
 				s.logger.Error("[%s] !!Check!! recvChan invalid msg: %+v", s.Name(), v)
+				SendMsg(ctx, newDeadLetterMsg(v, s.origin(), "invalid msg"))
 				continue
 			}
 			switch msg.Type() {
 			case MsgStartError:
-				err := msg.GetResponse()["error"].(error)
+				err := msg.GetError()
 				s.logger.Debug("plugin %s start() return: %v", s.Name(), err)
 				// send out message to service
 				msg.MsgTo = ChanKeyService
@@ -214,8 +434,13 @@ func (s *pluginRunner) chanHandler(ctx context.Context) error {
 			default:
 				if msg.To() == s.Name() {
 					s.logger.Error("recv an unknown message %+v", msg)
+					SendMsg(ctx, newDeadLetterMsg(msg, s.origin(), "unknown msg"))
 					continue
 				}
+				if msg.Type() == MsgPluginReady {
+					// plugin process doesn't know which start it is
+					msg.SetRequest(map[string]interface{}{"start_id": s.startID})
+				}
 				s.logger.Debug("routing msg '%+v' for plugin %s", msg, s.Name())
 				err := SendMsg(ctx, msg)
 				if err != nil {
@@ -224,58 +449,179 @@ func (s *pluginRunner) chanHandler(ctx context.Context) error {
 			}
 		}
 	}
-	return nil
+}
+
+//forward send msg to pluginserver, it returns false if plugin process
+//is found down. The msg is dead lettered then instead of replayed,
+//as it may be the one crashed the process.
+func (s *pluginRunner) forward(ctx context.Context, msg MsgBase) bool {
+	if msg.WantReply {
+		// wait for response in background, don't block other msgs
+		client := s.client()
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			err := forwardMsg(ctx, client, msg)
+			if err != nil {
+				s.logger.Error("failed to get response of msg %+v: %v", msg, err)
+				if ErrorCode(err) == ErrCodeUnavailable {
+					s.notifyCrash()
+				}
+			}
+		}()
+		return true
+	}
+	req, err := msgReq(msg)
+	if err != nil {
+		s.logger.Error("failed to convert %+v to pbReq: %v", msg, err)
+		SendMsg(ctx, newDeadLetterMsg(msg, s.origin(), err.Error()))
+		return true
+	}
+	_, err = s.client().Request(context.Background(), req)
+	if err != nil {
+		s.logger.Error("failed to send msg to pluginserver: %v", err)
+		SendMsg(ctx, newDeadLetterMsg(msg, s.origin(), err.Error()))
+		if ErrorCode(rpcError(msg, err)) == ErrCodeUnavailable || s.exited() {
+			s.notifyCrash()
+			return false
+		}
+	}
+	return true
+}
+
+//drain wait until msgs forwarded to plugin process are taken by plugin
+//from its queue, and the replies of them are back, or ctx is done.
+//Call it after in-chan of plugin gets no more msgs.
+func (s *pluginRunner) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case s.drains <- done:
+	case <-ctx.Done():
+		return NewError(ErrCodeTimeout, "failed to drain plugin %s: %v", s.Name(), ctx.Err())
+	}
+	<-done
+	msg := NewMsg(s.Name(), MsgFuncDrain)
+	req, err := msgReq(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client().Request(ctx, req)
+	if err != nil {
+		return rpcError(msg, err)
+	}
+	rmsg, _ := respMsg(resp)
+	err = rmsg.GetError()
+	if err != nil {
+		return err
+	}
+	replied := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(replied)
+	}()
+	select {
+	case <-replied:
+		return nil
+	case <-ctx.Done():
+		return NewError(ErrCodeTimeout, "replies of plugin %s aren't back: %v", s.Name(), ctx.Err())
+	}
+}
+
+//sendDead reject msg as plugin process can't be respawned
+func (s *pluginRunner) sendDead(ctx context.Context, msg MsgBase) {
+	if msg.WantReply {
+		msg.SetError(NewError(ErrCodeUnavailable, "plugin process of %s is dead", s.Name()))
+		return
+	}
+	SendMsg(ctx, newDeadLetterMsg(msg, s.origin(), "plugin process is dead"))
+}
+
+//client returns client of current plugin process
+func (s *pluginRunner) client() proto.PluginSvcClient {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.svcClient
 }
 
 //Start send start request to pluginserver
 func (s *pluginRunner) Start(ctx context.Context) error {
+	s.startID, _ = ctx.Value(CtxKeyStartID).(string)
+	err := s.start()
+	if err != nil {
+		return err
+	}
+	// start chanHandler
+	go s.chanHandler(ctx)
+	go s.watch(ctx)
+	return nil
+}
+
+func (s *pluginRunner) start() error {
+	s.mut.Lock()
+	broker := s.broker
+	client := s.svcClient
+	s.mut.Unlock()
 	//start rpcChan
-	brokerID := s.broker.NextId()
-	go s.broker.AcceptAndServe(brokerID, s.serverFunc)
+	brokerID := broker.NextId()
+	go broker.AcceptAndServe(brokerID, s.serverFunc)
 	// s.inChan = InChan(ctx)
 	// s.outChan = OutChan(ctx)
 
 	//run plugin.start
 	msg := NewMsg(s.Name(), MsgFuncStart)
-	msg.SetRequest(map[string]interface{}{"brokerID": brokerID})
+	startReq, err := encodePayload(startRequest{BrokerID: brokerID, Mailbox: s.mailboxConf, Name: s.Name()})
+	if err != nil {
+		return err
+	}
+	msg.SetRequest(startReq)
 	req, err := msgReq(msg)
 	if err != nil {
 		return err
 	}
 	// send start plugin request
-	resp, err := s.svcClient.Request(context.Background(), req)
+	resp, err := client.Request(context.Background(), req)
 	if err != nil {
 		return err
 	}
 	// Response is error message
 	rmsg, _ := respMsg(resp)
-	errInt := rmsg.GetResponse()["error"]
-	if errInt != nil {
-		return errInt.(error)
-	}
-	// start chanHandler
-	go s.chanHandler(ctx)
-	return nil
+	return rmsg.GetError()
 }
 
 func (s *pluginRunner) Stop(ctx context.Context) error {
+	s.mut.Lock()
+	// no respawn from now on, the process is no longer swapped
+	s.stopping = true
+	client := s.svcClient
+	cmd := s.cmd
+	pluginClient := s.pluginClient
+	s.mut.Unlock()
 	//run plugin.stop
 	msg := NewMsg(s.Name(), MsgFuncStop)
 	req, err := msgReq(msg)
 	if err != nil {
 		return err
 	}
-	resp, err := s.svcClient.Request(context.Background(), req)
-	rmsg, _ := respMsg(resp)
-	errIntf := rmsg.GetResponse()["error"]
-	if errIntf != nil {
-		return errIntf.(error)
+	resp, err := client.Request(ctx, req)
+	if err != nil {
+		// plugin process may be dead, kill it anyway
+		err = rpcError(msg, err)
+		if ctx.Err() != nil && cmd.Process != nil {
+			s.logger.Error("plugin %s missed stop deadline, killing plugin process", s.Name())
+			cmd.Process.Kill()
+		}
+	} else {
+		rmsg, _ := respMsg(resp)
+		err = rmsg.GetError()
 	}
 	//stop chanRPC
-	if s.chanRPC != nil {
-		s.chanRPC.Stop()
+	s.mut.Lock()
+	chanRPC := s.chanRPC
+	s.mut.Unlock()
+	if chanRPC != nil {
+		chanRPC.Stop()
 	}
 	//stop plugin process
-	s.pluginClient.Kill()
-	return nil
+	pluginClient.Kill()
+	return err
 }
@@ -3,13 +3,17 @@ package elsvc
 import (
 	context "context"
 	"encoding/json"
+	fmt "fmt"
 	"os"
+	"time"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/lynic/elsvc/proto"
 	"google.golang.org/grpc"
 )
 
+const drainInterval = 10 * time.Millisecond
+
 type pluginServer struct {
 	PluginImpl  PluginIntf
 	broker      *plugin.GRPCBroker
@@ -17,9 +21,19 @@ type pluginServer struct {
 	conn        *grpc.ClientConn
 	client      proto.PluginSvcClient
 	chans       map[string]chan interface{}
+	mailbox     *mailbox // lanes feeding in-chan of plugin
+	name        string   // instance name of plugin, set by start
 	logger      *Logger
 }
 
+//instance returns instance name of plugin, msgs sent to it are delivered to this process
+func (s *pluginServer) instance() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.PluginImpl.ModuleName()
+}
+
 func (s *pluginServer) handler(ctx context.Context) error {
 	for {
 		select {
@@ -32,28 +46,86 @@ func (s *pluginServer) handler(ctx context.Context) error {
 			msg, ok := v.(MsgBase)
 			if !ok {
 				s.logger.Error("failed to convert to MsgBase: %+v", v)
+				s.reportDeadLetter(v, "invalid msg")
+				continue
+			}
+			if msg.WantReply {
+				// wait for response in background, don't block other msgs
+				go func() {
+					err := forwardMsg(ctx, s.client, msg)
+					if err != nil {
+						s.logger.Error("failed to get response of msg %+v: %v", msg, err)
+					}
+				}()
 				continue
 			}
 			req, err := msgReq(msg)
 			if err != nil {
 				s.logger.Error("failed to convert %+v to pbReq: %s", msg, err.Error())
+				s.reportDeadLetter(msg, err.Error())
 				continue
 			}
-			resp, err := s.client.Request(context.Background(), req)
+			_, err = s.client.Request(context.Background(), req)
 			if err != nil {
 				s.logger.Error("failed to to get response from req: %s", err.Error())
 				continue
 			}
-			msg.SetRequestBytes(resp.Response)
 		}
 	}
-	return nil
+}
+
+//reportDeadLetter tell service that v is dropped by plugin server
+func (s *pluginServer) reportDeadLetter(v interface{}, reason string) {
+	origin := fmt.Sprintf("pluginServer.%s", s.instance())
+	req, err := msgReq(newDeadLetterMsg(v, origin, reason))
+	if err != nil {
+		s.logger.Error("failed to convert dead letter of %+v: %v", v, err)
+		return
+	}
+	_, err = s.client.Request(context.Background(), req)
+	if err != nil {
+		s.logger.Error("failed to report dead letter of %+v: %v", v, err)
+	}
+}
+
+//overflowDrop handles msg dropped by mailbox for overflow
+func (s *pluginServer) overflowDrop(v interface{}, err error) {
+	s.logger.Error("dropping msg for overflow %+v: %v", v, err)
+	s.reportDeadLetter(v, err.Error())
+	if msg, ok := v.(MsgBase); ok {
+		msg.SetError(err)
+	}
+}
+
+//drain wait for plugin to take msgs queued in mailbox until ctx is done
+func (s *pluginServer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		n := s.mailbox.pending()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return NewError(ErrCodeTimeout, "%d msgs are left in queue of %s", n, s.instance())
+		}
+	}
 }
 
 func (s *pluginServer) startWrapper(ctx context.Context) error {
 	err := s.PluginImpl.Start(ctx)
-	msg := NewMsg(s.PluginImpl.ModuleName(), MsgStartError)
+	msg := NewMsg(s.instance(), MsgStartError)
 	msg.SetRequest(map[string]interface{}{"error": err})
+	// queued after msgs sent by plugin before it returned, e.g. its job result
+	if ctx.Err() == nil {
+		select {
+		case s.chans[ChanKeyService] <- msg:
+			return nil
+		case <-ctx.Done():
+		}
+	}
 	req, _ := msgReq(msg)
 	_, err = s.client.Request(context.Background(), req)
 	if err != nil {
@@ -76,6 +148,15 @@ func (s *pluginServer) Request(ctx context.Context, req *proto.MsgRequest) (*pro
 		}
 		s.logger.Debug("send MsgFuncName response %+v", resp)
 		return resp, nil
+	case MsgFuncInfo:
+		msg := NewMsg(req.To, req.Type)
+		// runner waits for the response even if plugin has no info
+		resp := make(map[string]interface{})
+		if pi, ok := s.PluginImpl.(PluginInfo); ok {
+			resp["info"] = pi.Info()
+		}
+		msg.SetResponse(resp)
+		return msgResp(msg)
 	case MsgSetEnv:
 		s.logger.Debug("recv MsgSetEnv request %+v", req)
 		envKV := make(map[string]string)
@@ -96,45 +177,52 @@ func (s *pluginServer) Request(ctx context.Context, req *proto.MsgRequest) (*pro
 		return resp, nil
 	case MsgFuncInit:
 		s.logger.Debug("Recv init req: %+v", req)
-		resp := &proto.MsgResponse{}
+		msg := NewMsg(req.To, req.Type)
 		conf := make(map[string]interface{})
 		err := json.Unmarshal(req.Request, &conf)
 		if err != nil {
-			data, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
-			resp.Response = data
-			return resp, nil
+			msg.SetError(NewError(ErrCodeRejected, "invalid config: %v", err))
+			return msgResp(msg)
 		}
 		s.logger.Debug("Init config content: %+v", conf)
 		ctx := context.WithValue(context.Background(), CtxKeyConfig, conf)
-		err = s.PluginImpl.Init(ctx)
-		if err != nil {
-			data, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
-			resp.Response = data
-			return resp, nil
-		}
-		data, _ := json.Marshal(map[string]interface{}{"error": ""})
-		resp.Response = data
-		return resp, nil
+		msg.SetError(s.PluginImpl.Init(ctx))
+		return msgResp(msg)
 	case MsgFuncStart:
 		s.logger.Debug("Recv start req: %+v", req)
 		msg, _ := reqMsg(req)
 		// create bidirection grpc connection
-		brokerID := uint32(msg.GetRequest()["brokerID"].(float64))
-		conn, err := s.broker.Dial(brokerID)
+		start := startRequest{}
+		err := DecodeRequest(msg, &start)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := s.broker.Dial(start.BrokerID)
 		if err != nil {
 			return nil, err
 		}
 		s.conn = conn
 		s.client = proto.NewPluginSvcClient(conn)
+		mbConf := start.Mailbox
+		if len(mbConf.Lanes) == 0 {
+			// sent by older runner
+			mbConf, _ = newMailboxConfig(nil, 0, "", "")
+		}
 
-		// create chans for plugin
+		s.name = start.Name
+
+		// create chans for plugin, msgs are queued in lanes of mailbox
+		name := s.instance()
 		s.chans = make(map[string]chan interface{})
-		s.chans[s.PluginImpl.ModuleName()] = make(chan interface{}, defaultChanLength)
+		s.chans[name] = make(chan interface{})
 		s.chans[ChanKeyService] = make(chan interface{}, defaultChanLength)
+		s.mailbox = newMailbox(name, mbConf, s.chans[name], s.overflowDrop)
+		go s.mailbox.run()
 
 		// create ctx for start
-		ctx := context.WithValue(context.Background(), CtxKeyInchan, s.chans[s.PluginImpl.ModuleName()])
+		ctx := context.WithValue(context.Background(), CtxKeyInchan, s.chans[name])
 		ctx = context.WithValue(ctx, CtxKeyOutchan, s.chans[ChanKeyService])
+		ctx = context.WithValue(ctx, CtxKeyName, name)
 		ctx, cancel := context.WithCancel(ctx)
 		s.cancelStart = cancel
 		// start chan handler
@@ -144,33 +232,78 @@ func (s *pluginServer) Request(ctx context.Context, req *proto.MsgRequest) (*pro
 		return &proto.MsgResponse{}, nil
 	case MsgFuncStop:
 		s.logger.Debug("Recv stop req: %+v", req)
-		err := s.PluginImpl.Stop(context.Background())
-		resp := &proto.MsgResponse{}
+		msg := NewMsg(req.To, req.Type)
+		msg.SetError(s.PluginImpl.Stop(context.Background()))
+		return msgResp(msg)
+	case MsgFuncHealth:
+		msg := NewMsg(req.To, req.Type)
+		// plugin is healthy as long as it serves if it has no health check
+		var err error
+		if hc, ok := s.PluginImpl.(HealthChecker); ok {
+			err = hc.Health(ctx)
+		}
+		msg.SetError(err)
+		return msgResp(msg)
+	case MsgFuncConfig:
+		s.logger.Debug("Recv reconfigure req: %+v", req)
+		msg := NewMsg(req.To, req.Type)
+		conf := make(map[string]interface{})
+		err := json.Unmarshal(req.Request, &conf)
 		if err != nil {
-			data, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
-			resp.Response = data
-			return resp, nil
+			msg.SetError(NewError(ErrCodeRejected, "invalid config: %v", err))
+			return msgResp(msg)
 		}
-		data, _ := json.Marshal(map[string]interface{}{"error": ""})
-		resp.Response = data
-		return resp, nil
+		rc, ok := s.PluginImpl.(Reconfigurer)
+		if !ok {
+			msg.SetError(NewError(ErrCodeNotFound, "plugin %s can't be reconfigured", s.instance()))
+			return msgResp(msg)
+		}
+		ctx := context.WithValue(ctx, CtxKeyConfig, conf)
+		msg.SetError(rc.Reconfigure(ctx))
+		return msgResp(msg)
+	case MsgFuncDrain:
+		msg := NewMsg(req.To, req.Type)
+		msg.SetError(s.drain(ctx))
+		return msgResp(msg)
 	case MsgCtxDone:
 		s.logger.Debug("Recv ctxDone req: %+v", req)
 		// cancel from start
 		s.cancelStart()
+		s.mailbox.close()
+		for _, v := range s.mailbox.drain() {
+			s.overflowDrop(v, NewError(ErrCodeUnavailable, "plugin %s is stopped", s.instance()))
+		}
 		s.conn.Close()
 	default:
 		s.logger.Debug("Recv req to inChan: %+v", req)
 		// receive inchan message
 		msg, err := reqMsg(req)
 		if err != nil {
-			err := s.logger.Error("failed to convert req: %+v", req)
-			resp := &proto.MsgResponse{}
-			data, _ := json.Marshal(map[string]interface{}{"error": err.Error()})
-			resp.Response = data
-			return resp, nil
+			s.logger.Error("failed to convert req: %+v", req)
+			msg.SetError(NewError(ErrCodeRejected, "failed to convert req: %v", err))
+			return msgResp(msg)
+		}
+		// reject payload doesn't match type registered in plugin
+		if err := validatePayload(msg); err != nil {
+			s.logger.Error("reject msg %+v: %v", msg, err)
+			s.reportDeadLetter(msg, err.Error())
+			msg.SetError(err)
+			return msgResp(msg)
+		}
+		err = s.mailbox.put(msg)
+		if err != nil {
+			s.logger.Error("reject msg %+v: %v", msg, err)
+			msg.SetError(err)
+			return msgResp(msg)
+		}
+		if msg.WantReply {
+			// hold the rpc until plugin responses or caller gives up
+			_, err := msg.GetResponseContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return msgResp(msg)
 		}
-		s.chans[s.PluginImpl.ModuleName()] <- msg
 	}
 	return &proto.MsgResponse{}, nil
 }
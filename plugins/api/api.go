@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -18,6 +19,9 @@ var PluginObj *APIServer
 
 const ModuleName = "svcapi"
 
+// requestTimeout bounds how long postMsg waits for a plugin to response
+const requestTimeout = 30 * time.Second
+
 type APIServer struct {
 	ListenAddr string `json:"listen_addr"`
 	ListenPort string `json:"listen_port"`
@@ -81,6 +85,19 @@ func (s *APIServer) Stop(context.Context) error {
 	return nil
 }
 
+// available reports whether a plugin listed with its status could take msgs
+func available(status interface{}) bool {
+	st, ok := status.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	switch st["state"] {
+	case string(elsvc.StateStopped), string(elsvc.StateFailed):
+		return false
+	}
+	return true
+}
+
 func (s *APIServer) postMsg(w http.ResponseWriter, r *http.Request) {
 	msg := &elsvc.MsgBase{}
 	datas, err := ioutil.ReadAll(r.Body)
@@ -112,29 +129,16 @@ func (s *APIServer) postMsg(w http.ResponseWriter, r *http.Request) {
 		w.Write(bb)
 		return
 	}
+	ctx, cancel := context.WithTimeout(s.ctx, requestTimeout)
+	defer cancel()
 	reqMsg := elsvc.NewMsg(elsvc.ChanKeyService, elsvc.MsgListPlugins)
-	elsvc.OutChan(s.ctx) <- reqMsg
-	if reqMsg.GetError() != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		resp := map[string]string{
-			"error": reqMsg.GetError().Error(),
-		}
-		bb, _ := json.Marshal(resp)
-		w.Write(bb)
-		return
-	}
-	plugins := make(map[string]bool)
-	err = json.Unmarshal(reqMsg.GetResponseBytes(), &plugins)
+	plugins, err := elsvc.Request(ctx, reqMsg)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		resp := map[string]string{
-			"error": err.Error(),
-		}
-		bb, _ := json.Marshal(resp)
-		w.Write(bb)
+		writeError(w, err)
 		return
 	}
-	if _, ok := plugins[msg.To()]; !ok {
+	// msg to service is a control msg, e.g. list_dead_letters
+	if !available(plugins[msg.To()]) && msg.To() != elsvc.ChanKeyService {
 		w.WriteHeader(http.StatusBadRequest)
 		resp := map[string]string{
 			"error": fmt.Sprintf("plugin %s not available", msg.To()),
@@ -143,16 +147,40 @@ func (s *APIServer) postMsg(w http.ResponseWriter, r *http.Request) {
 		w.Write(bb)
 		return
 	}
-	elsvc.OutChan(s.ctx) <- msg
-	if msg.GetError() != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		resp := map[string]string{
-			"error": msg.GetError().Error(),
-		}
-		bb, _ := json.Marshal(resp)
-		w.Write(bb)
+	sendMsg := elsvc.NewMsg(msg.To(), msg.Type())
+	sendMsg.SetRequest(msg.MsgRequest)
+	sendMsg.Priority = msg.Priority
+	// keep tracing id of the caller
+	if msg.Correlation() != "" {
+		sendMsg.CorrelationId = msg.Correlation()
+	}
+	_, err = elsvc.Request(ctx, sendMsg)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(msg.GetResponseBytes())
+	w.Write(sendMsg.GetResponseBytes())
+}
+
+//writeError write err with the http status of its code
+func writeError(w http.ResponseWriter, err error) {
+	merr := elsvc.AsMsgError(err)
+	switch merr.Code {
+	case elsvc.ErrCodeTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case elsvc.ErrCodeNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case elsvc.ErrCodeRejected, elsvc.ErrCodeExpired:
+		w.WriteHeader(http.StatusBadRequest)
+	case elsvc.ErrCodeUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	resp := map[string]interface{}{
+		"error": merr,
+	}
+	bb, _ := json.Marshal(resp)
+	w.Write(bb)
 }
@@ -22,6 +22,16 @@ func (s Hello) ModuleName() string {
 	return ModuleName
 }
 
+//Info describes hello, see elsvc.PluginInfo
+func (s Hello) Info() elsvc.PluginMeta {
+	return elsvc.PluginMeta{
+		Version:     "1.0.0",
+		Description: "prints its name",
+		APIVersion:  "1.0",
+		MsgTypes:    []string{"hello_printname"},
+	}
+}
+
 func (s *Hello) Init(ctx context.Context) error {
 	elsvc.Info("env helloenv is %s", os.Getenv("helloenv"))
 	err := elsvc.LoadConfig(ctx, s)
@@ -34,9 +44,8 @@ func (s *Hello) Init(ctx context.Context) error {
 
 func (s *Hello) Start(ctx context.Context) error {
 	elsvc.Info("Hello.%s start", s.Name)
-	// send msg to self channel
-	msg := elsvc.NewMsg(s.ModuleName(), "hello_printname")
-	msg.MsgTo = s.ModuleName()
+	// send msg to self channel, addressed as instance name
+	msg := elsvc.NewMsg(elsvc.PluginName(ctx), "hello_printname")
 	elsvc.SendMsg(ctx, msg)
 	for {
 		select {
@@ -69,6 +78,11 @@ func init() {
 	PluginObj = Hello{}
 }
 
+//NewPlugin creates named instances of hello in plugin_mode=goplugin
+func NewPlugin() elsvc.PluginIntf {
+	return &Hello{}
+}
+
 //main() only needed for plugin_mode=hcplugin
 func main() {
 	elsvc.StartPlugin(&PluginObj)
@@ -118,23 +118,93 @@ func (m *MsgLog) GetTimestamp() uint64 {
 	return 0
 }
 
-type MsgRequest struct {
-	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	From                 string   `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
-	To                   string   `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
-	Type                 string   `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
-	Ttl                  int64    `protobuf:"varint,5,opt,name=ttl,proto3" json:"ttl,omitempty"`
-	Request              []byte   `protobuf:"bytes,6,opt,name=request,proto3" json:"request,omitempty"`
+type MsgError struct {
+	Code                 int64    `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message              string   `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Retryable            bool     `protobuf:"varint,3,opt,name=retryable,proto3" json:"retryable,omitempty"`
+	Details              []byte   `protobuf:"bytes,4,opt,name=details,proto3" json:"details,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
+func (m *MsgError) Reset()         { *m = MsgError{} }
+func (m *MsgError) String() string { return proto.CompactTextString(m) }
+func (*MsgError) ProtoMessage()    {}
+func (*MsgError) Descriptor() ([]byte, []int) {
+	return fileDescriptor_33f3a5e1293a7bcd, []int{2}
+}
+
+func (m *MsgError) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MsgError.Unmarshal(m, b)
+}
+func (m *MsgError) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MsgError.Marshal(b, m, deterministic)
+}
+func (m *MsgError) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MsgError.Merge(m, src)
+}
+func (m *MsgError) XXX_Size() int {
+	return xxx_messageInfo_MsgError.Size(m)
+}
+func (m *MsgError) XXX_DiscardUnknown() {
+	xxx_messageInfo_MsgError.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MsgError proto.InternalMessageInfo
+
+func (m *MsgError) GetCode() int64 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *MsgError) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *MsgError) GetRetryable() bool {
+	if m != nil {
+		return m.Retryable
+	}
+	return false
+}
+
+func (m *MsgError) GetDetails() []byte {
+	if m != nil {
+		return m.Details
+	}
+	return nil
+}
+
+type MsgRequest struct {
+	Id                   string            `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	From                 string            `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	To                   string            `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
+	Type                 string            `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+	Ttl                  int64             `protobuf:"varint,5,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Request              []byte            `protobuf:"bytes,6,opt,name=request,proto3" json:"request,omitempty"`
+	Deadline             int64             `protobuf:"varint,7,opt,name=deadline,proto3" json:"deadline,omitempty"`
+	WantReply            bool              `protobuf:"varint,8,opt,name=want_reply,json=wantReply,proto3" json:"want_reply,omitempty"`
+	CorrelationId        string            `protobuf:"bytes,9,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	CausationId          string            `protobuf:"bytes,10,opt,name=causation_id,json=causationId,proto3" json:"causation_id,omitempty"`
+	Error                *MsgError         `protobuf:"bytes,11,opt,name=error,proto3" json:"error,omitempty"`
+	Priority             int32             `protobuf:"varint,12,opt,name=priority,proto3" json:"priority,omitempty"`
+	Headers              map[string]string `protobuf:"bytes,13,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
 func (m *MsgRequest) Reset()         { *m = MsgRequest{} }
 func (m *MsgRequest) String() string { return proto.CompactTextString(m) }
 func (*MsgRequest) ProtoMessage()    {}
 func (*MsgRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_33f3a5e1293a7bcd, []int{2}
+	return fileDescriptor_33f3a5e1293a7bcd, []int{3}
 }
 
 func (m *MsgRequest) XXX_Unmarshal(b []byte) error {
@@ -197,23 +267,75 @@ func (m *MsgRequest) GetRequest() []byte {
 	return nil
 }
 
+func (m *MsgRequest) GetDeadline() int64 {
+	if m != nil {
+		return m.Deadline
+	}
+	return 0
+}
+
+func (m *MsgRequest) GetWantReply() bool {
+	if m != nil {
+		return m.WantReply
+	}
+	return false
+}
+
+func (m *MsgRequest) GetCorrelationId() string {
+	if m != nil {
+		return m.CorrelationId
+	}
+	return ""
+}
+
+func (m *MsgRequest) GetCausationId() string {
+	if m != nil {
+		return m.CausationId
+	}
+	return ""
+}
+
+func (m *MsgRequest) GetError() *MsgError {
+	if m != nil {
+		return m.Error
+	}
+	return nil
+}
+
+func (m *MsgRequest) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *MsgRequest) GetHeaders() map[string]string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
 type MsgResponse struct {
-	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	From                 string   `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
-	To                   string   `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
-	Type                 string   `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
-	Code                 int64    `protobuf:"varint,5,opt,name=code,proto3" json:"code,omitempty"`
-	Response             []byte   `protobuf:"bytes,6,opt,name=response,proto3" json:"response,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Id                   string    `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	From                 string    `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	To                   string    `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
+	Type                 string    `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+	Code                 int64     `protobuf:"varint,5,opt,name=code,proto3" json:"code,omitempty"`
+	Response             []byte    `protobuf:"bytes,6,opt,name=response,proto3" json:"response,omitempty"`
+	CorrelationId        string    `protobuf:"bytes,7,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	CausationId          string    `protobuf:"bytes,8,opt,name=causation_id,json=causationId,proto3" json:"causation_id,omitempty"`
+	Error                *MsgError `protobuf:"bytes,9,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
 }
 
 func (m *MsgResponse) Reset()         { *m = MsgResponse{} }
 func (m *MsgResponse) String() string { return proto.CompactTextString(m) }
 func (*MsgResponse) ProtoMessage()    {}
 func (*MsgResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_33f3a5e1293a7bcd, []int{3}
+	return fileDescriptor_33f3a5e1293a7bcd, []int{4}
 }
 
 func (m *MsgResponse) XXX_Unmarshal(b []byte) error {
@@ -276,35 +398,71 @@ func (m *MsgResponse) GetResponse() []byte {
 	return nil
 }
 
+func (m *MsgResponse) GetCorrelationId() string {
+	if m != nil {
+		return m.CorrelationId
+	}
+	return ""
+}
+
+func (m *MsgResponse) GetCausationId() string {
+	if m != nil {
+		return m.CausationId
+	}
+	return ""
+}
+
+func (m *MsgResponse) GetError() *MsgError {
+	if m != nil {
+		return m.Error
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*MsgEmpty)(nil), "proto.MsgEmpty")
 	proto.RegisterType((*MsgLog)(nil), "proto.MsgLog")
+	proto.RegisterType((*MsgError)(nil), "proto.MsgError")
 	proto.RegisterType((*MsgRequest)(nil), "proto.MsgRequest")
+	proto.RegisterMapType((map[string]string)(nil), "proto.MsgRequest.HeadersEntry")
 	proto.RegisterType((*MsgResponse)(nil), "proto.MsgResponse")
 }
 
 func init() { proto.RegisterFile("proto/message.proto", fileDescriptor_33f3a5e1293a7bcd) }
 
 var fileDescriptor_33f3a5e1293a7bcd = []byte{
-	// 282 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x91, 0xb1, 0x4e, 0xfb, 0x30,
-	0x10, 0xc6, 0xe5, 0x34, 0x4d, 0x9b, 0xfb, 0xff, 0x85, 0xe0, 0x90, 0x90, 0x55, 0x31, 0x44, 0x99,
-	0x32, 0x15, 0x04, 0x33, 0x23, 0x1b, 0x95, 0x90, 0x79, 0x82, 0xd2, 0x1c, 0x56, 0x24, 0xbb, 0x0e,
-	0xf1, 0xa5, 0x52, 0x37, 0x16, 0xde, 0x1b, 0xc5, 0x71, 0x5a, 0x1e, 0x80, 0xc9, 0xdf, 0x77, 0x77,
-	0xf6, 0xef, 0xd3, 0x19, 0xae, 0xdb, 0xce, 0xb1, 0xbb, 0xb3, 0xe4, 0xfd, 0x56, 0xd3, 0x3a, 0x38,
-	0x9c, 0x87, 0xa3, 0x04, 0x58, 0x6e, 0xbc, 0x7e, 0xb6, 0x2d, 0x1f, 0x4b, 0x86, 0x6c, 0xe3, 0xf5,
-	0x8b, 0xd3, 0x78, 0x03, 0x99, 0x75, 0x75, 0x6f, 0x48, 0x8a, 0x42, 0x54, 0xb9, 0x8a, 0x0e, 0x57,
-	0xb0, 0x34, 0x4e, 0x1b, 0x3a, 0x90, 0x91, 0x49, 0xe8, 0x9c, 0x3c, 0x4a, 0x58, 0x44, 0x82, 0x9c,
-	0x85, 0xd6, 0x64, 0xf1, 0x16, 0x72, 0x6e, 0x2c, 0x79, 0xde, 0xda, 0x56, 0xa6, 0x85, 0xa8, 0x52,
-	0x75, 0x2e, 0x94, 0x5f, 0x02, 0x60, 0xe3, 0xb5, 0xa2, 0xcf, 0x9e, 0x3c, 0xe3, 0x05, 0x24, 0x4d,
-	0x1d, 0xb1, 0x49, 0x53, 0x23, 0x42, 0xfa, 0xd1, 0x39, 0x1b, 0x71, 0x41, 0x0f, 0x33, 0xec, 0x22,
-	0x25, 0x61, 0x37, 0xcc, 0xf0, 0xb1, 0xa5, 0xf0, 0x76, 0xae, 0x82, 0xc6, 0x4b, 0x98, 0x31, 0x1b,
-	0x39, 0x2f, 0x44, 0x35, 0x53, 0x83, 0x1c, 0x02, 0x76, 0x23, 0x44, 0x66, 0x85, 0xa8, 0xfe, 0xab,
-	0xc9, 0x96, 0xdf, 0x02, 0xfe, 0x85, 0x08, 0xbe, 0x75, 0x7b, 0x4f, 0x7f, 0x96, 0x01, 0x21, 0xdd,
-	0xb9, 0x9a, 0x62, 0x88, 0xa0, 0x87, 0x15, 0x76, 0x91, 0x13, 0x63, 0x9c, 0xfc, 0xc3, 0x13, 0xe4,
-	0xaf, 0xa6, 0xd7, 0xcd, 0xfe, 0xed, 0xb0, 0xc3, 0x7b, 0x58, 0x4c, 0x3b, 0xb9, 0x1a, 0xff, 0x6c,
-	0x7d, 0x5e, 0xd3, 0x0a, 0x7f, 0x97, 0xc6, 0xeb, 0xef, 0x59, 0x28, 0x3d, 0xfe, 0x04, 0x00, 0x00,
-	0xff, 0xff, 0xaa, 0x1b, 0x27, 0x80, 0xf0, 0x01, 0x00, 0x00,
+	// 490 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x52, 0x5d, 0x8b, 0xd3, 0x40,
+	0x14, 0x25, 0x69, 0xd3, 0x26, 0xb7, 0xdd, 0x55, 0x47, 0x91, 0xa1, 0xa8, 0xd4, 0xc2, 0x42, 0x9f,
+	0xaa, 0xd4, 0x97, 0x65, 0xc1, 0xc7, 0x05, 0x17, 0x2c, 0xc8, 0xf8, 0x03, 0x96, 0x6c, 0xe7, 0x1a,
+	0x83, 0x93, 0x4c, 0x9c, 0x99, 0x56, 0xf2, 0xe7, 0xfc, 0x59, 0x3e, 0xcb, 0x7c, 0x24, 0x0d, 0xac,
+	0x2c, 0x3e, 0xec, 0x53, 0xee, 0x39, 0x73, 0x33, 0xe7, 0xcc, 0x3d, 0x17, 0x9e, 0x37, 0x4a, 0x1a,
+	0xf9, 0xae, 0x42, 0xad, 0xf3, 0x02, 0x37, 0x0e, 0x91, 0xc4, 0x7d, 0x56, 0x00, 0xe9, 0x4e, 0x17,
+	0xd7, 0x55, 0x63, 0xda, 0x95, 0x81, 0xc9, 0x4e, 0x17, 0x9f, 0x65, 0x41, 0x5e, 0xc2, 0xa4, 0x92,
+	0xfc, 0x20, 0x90, 0x46, 0xcb, 0x68, 0x9d, 0xb1, 0x80, 0xc8, 0x02, 0x52, 0x21, 0x0b, 0x81, 0x47,
+	0x14, 0x34, 0x76, 0x27, 0x3d, 0x26, 0x14, 0xa6, 0x41, 0x81, 0x8e, 0xdc, 0x51, 0x07, 0xc9, 0x2b,
+	0xc8, 0x4c, 0x59, 0xa1, 0x36, 0x79, 0xd5, 0xd0, 0xf1, 0x32, 0x5a, 0x8f, 0xd9, 0x89, 0x58, 0x35,
+	0xde, 0x81, 0x52, 0x52, 0x11, 0x02, 0xe3, 0xbd, 0xe4, 0x5e, 0x75, 0xc4, 0x5c, 0x3d, 0xbc, 0x37,
+	0xbe, 0x77, 0xaf, 0x42, 0xa3, 0xda, 0xfc, 0x4e, 0x78, 0xcd, 0x94, 0x9d, 0x08, 0xfb, 0x1f, 0x47,
+	0x93, 0x97, 0x42, 0x3b, 0xcd, 0x39, 0xeb, 0xe0, 0xea, 0xf7, 0x08, 0x60, 0xa7, 0x0b, 0x86, 0x3f,
+	0x0f, 0xa8, 0x0d, 0x39, 0x87, 0xb8, 0xe4, 0xe1, 0xa1, 0x71, 0xc9, 0xad, 0x89, 0x6f, 0x4a, 0x56,
+	0x41, 0xcd, 0xd5, 0xb6, 0xc7, 0xc8, 0xf0, 0xae, 0xd8, 0x48, 0xdb, 0x63, 0xda, 0x06, 0xdd, 0xcd,
+	0x19, 0x73, 0x35, 0x79, 0x0a, 0x23, 0x63, 0x04, 0x4d, 0x9c, 0x77, 0x5b, 0x5a, 0x0b, 0xca, 0x8b,
+	0xd0, 0x89, 0xb7, 0x10, 0xa0, 0x1d, 0x24, 0xc7, 0x9c, 0x8b, 0xb2, 0x46, 0x3a, 0x75, 0x3f, 0xf4,
+	0x98, 0xbc, 0x06, 0xf8, 0x95, 0xd7, 0xe6, 0x56, 0x61, 0x23, 0x5a, 0x9a, 0xfa, 0x77, 0x59, 0x86,
+	0x59, 0x82, 0x5c, 0xc0, 0xf9, 0x5e, 0x2a, 0x85, 0x22, 0x37, 0xa5, 0xac, 0x6f, 0x4b, 0x4e, 0x33,
+	0x67, 0xe2, 0x6c, 0xc0, 0xde, 0x70, 0xf2, 0x16, 0xe6, 0xfb, 0xfc, 0xa0, 0xfb, 0x26, 0x70, 0x4d,
+	0xb3, 0x9e, 0xbb, 0xe1, 0xe4, 0x02, 0x12, 0xb4, 0x63, 0xa7, 0xb3, 0x65, 0xb4, 0x9e, 0x6d, 0x9f,
+	0xf8, 0xcd, 0xd8, 0x74, 0x69, 0x30, 0x7f, 0x6a, 0xbd, 0x36, 0xaa, 0x94, 0xaa, 0x34, 0x2d, 0x9d,
+	0x2f, 0xa3, 0x75, 0xc2, 0x7a, 0x4c, 0x2e, 0x61, 0xfa, 0x1d, 0x73, 0x8e, 0x4a, 0xd3, 0xb3, 0xe5,
+	0x68, 0x3d, 0xdb, 0xbe, 0x39, 0x5d, 0x12, 0xe6, 0xbb, 0xf9, 0xe4, 0x1b, 0xae, 0x6b, 0xa3, 0x5a,
+	0xd6, 0xb5, 0x2f, 0xae, 0x60, 0x3e, 0x3c, 0xb0, 0xd3, 0xfb, 0x81, 0x6d, 0x88, 0xc1, 0x96, 0xe4,
+	0x05, 0x24, 0xc7, 0x5c, 0x1c, 0xba, 0xd8, 0x3d, 0xb8, 0x8a, 0x2f, 0xa3, 0xd5, 0x9f, 0x08, 0x66,
+	0x4e, 0x40, 0x37, 0xb2, 0xd6, 0xf8, 0x68, 0x09, 0x76, 0xeb, 0x97, 0x0c, 0xd6, 0x6f, 0x01, 0xa9,
+	0x0a, 0x3a, 0x21, 0xc4, 0x1e, 0xff, 0x23, 0x8a, 0xe9, 0xff, 0x44, 0x91, 0x3e, 0x10, 0x45, 0xf6,
+	0x50, 0x14, 0xdb, 0x8f, 0x90, 0x7d, 0x11, 0x87, 0xa2, 0xac, 0xbf, 0x1e, 0xf7, 0xe4, 0x3d, 0x4c,
+	0xbb, 0x15, 0x7e, 0x76, 0x6f, 0xea, 0x0b, 0x32, 0xa4, 0xbc, 0xdf, 0xbb, 0x89, 0xa3, 0x3e, 0xfc,
+	0x1d, 0x00, 0x71, 0x0c, 0xb2, 0xc1, 0x11, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -0,0 +1,311 @@
+package elsvc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+//Actions of plugins in a config reload
+const (
+	ReloadAdded        = "added"
+	ReloadRemoved      = "removed"
+	ReloadRestarted    = "restarted"
+	ReloadReconfigured = "reconfigured" // plugin applied its new config without restarting
+)
+
+//ReloadResult is what a config reload did to a plugin
+type ReloadResult struct {
+	Action     string    `json:"action"`
+	Error      *MsgError `json:"error,omitempty"`
+	RolledBack bool      `json:"rolled_back,omitempty"` // undone as the reload failed
+}
+
+//reloadStep is a change of plugin made by reload, it's undone if reload fails
+type reloadStep struct {
+	name   string
+	action string
+	old    PluginConfig
+	new    PluginConfig
+}
+
+//reloadConfig read config file again, configPath if it's not empty, and apply
+//the diff against the running config to plugins. Plugins changed are restarted,
+//or reconfigured if only their config changed. If a plugin fails to be changed
+//the ones changed already are rolled back, so plugins keep running as before.
+func (s *Service) reloadConfig(configPath string) (map[string]*ReloadResult, error) {
+	if configPath == "" {
+		configPath = s.configPath
+	}
+	s.logger.Info("Reloading config %s", configPath)
+	if s.config.RunMode != RunModeSvc {
+		return nil, NewError(ErrCodeRejected, "config could only be reloaded in %s mode", RunModeSvc)
+	}
+	conf, order, err := readConfig(configPath)
+	if err != nil {
+		return nil, NewError(ErrCodeRejected, "invalid config %s: %v", configPath, err)
+	}
+	err = s.checkReload(conf)
+	if err != nil {
+		return nil, err
+	}
+	steps := s.diffConfig(conf, order)
+	for _, step := range steps {
+		err := s.checkStep(step)
+		if err != nil {
+			result := &ReloadResult{Action: step.action, Error: AsMsgError(err)}
+			return map[string]*ReloadResult{step.name: result}, wrapError(err, "failed to reload plugin %s", step.name)
+		}
+	}
+	results := make(map[string]*ReloadResult)
+	for _, step := range steps {
+		results[step.name] = &ReloadResult{Action: step.action}
+	}
+	applied := make([]*reloadStep, 0, len(steps))
+	for _, step := range steps {
+		err := s.applyStep(step)
+		results[step.name].Action = step.action
+		results[step.name].Error = AsMsgError(err)
+		if err == nil {
+			applied = append(applied, step)
+			continue
+		}
+		if step.action == ReloadRemoved {
+			// unloaded even if it failed to stop
+			s.logger.Error("failed to stop plugin %s: %v", step.name, err)
+			continue
+		}
+		s.logger.Error("failed to reload plugin %s: %v", step.name, err)
+		if step.action != ReloadReconfigured {
+			// clean up what's done before it failed
+			applied = append(applied, step)
+		}
+		s.rollback(applied, results)
+		return results, wrapError(err, "failed to reload plugin %s", step.name)
+	}
+	err = logger.SetLogLevel(conf.LogLevel)
+	if err != nil {
+		s.logger.Error("failed to set logLevel to %s: %v", conf.LogLevel, err)
+	}
+	s.config = conf
+	s.configPath = configPath
+	s.logger.Info("Reloaded config %s, %d plugins changed", configPath, len(steps))
+	return results, nil
+}
+
+//checkReload fails if settings of conf couldn't be changed while service is running
+func (s *Service) checkReload(conf *ServiceConfig) error {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"plugin_mode", s.config.PluginMode, conf.PluginMode},
+		{"run_mode", s.config.RunMode, conf.RunMode},
+		{"chan_length", s.config.ChanLength, conf.ChanLength},
+		{"verify_plugins", s.config.VerifyPlugins, conf.VerifyPlugins},
+		{"trusted_keys", strings.Join(s.config.TrustedKeys, ","), strings.Join(conf.TrustedKeys, ",")},
+	}
+	for _, f := range fields {
+		if f.old != f.new {
+			return NewError(ErrCodeRejected, "%s couldn't be changed from %v to %v without restarting service", f.name, f.old, f.new).
+				WithDetail("field", f.name)
+		}
+	}
+	return nil
+}
+
+//checkStep fails if plugin couldn't be added or changed as step
+func (s *Service) checkStep(step *reloadStep) error {
+	if step.action == ReloadRemoved {
+		return nil
+	}
+	if _, ok := s.mailboxes[step.name]; ok && step.action == ReloadAdded {
+		// e.g. loaded with MsgLoadPlugin
+		return NewError(ErrCodeRejected, "plugin %s is loaded already", step.name)
+	}
+	if _, err := s.validatePlugin(step.new); err != nil {
+		return err
+	}
+	if step.action == ReloadRestarted && s.config.PluginMode == PluginModeGO {
+		err := checkGoRestart(step.old, step.new)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := step.new.findSO()
+	return err
+}
+
+//checkGoRestart fails if new changes what a restart can't apply in goplugin mode,
+//the loaded .so is reused and env is only set when it's opened
+func checkGoRestart(old, new PluginConfig) error {
+	fields := []struct {
+		name    string
+		changed bool
+	}{
+		{"env", !reflect.DeepEqual(old.EnvMap, new.EnvMap)},
+		{"plugin_path", old.PluginDir != new.PluginDir},
+		{"version", old.Version != new.Version},
+	}
+	for _, f := range fields {
+		if f.changed {
+			return NewError(ErrCodeRejected, "%s of plugin %s couldn't be changed in %s mode without restarting service",
+				f.name, new.InstanceName(), PluginModeGO).WithDetail("field", f.name)
+		}
+	}
+	return nil
+}
+
+//diffConfig returns the changes from running config to conf, plugins are added and
+//changed in order of dependencies, then the removed ones are unloaded in reverse order
+func (s *Service) diffConfig(conf *ServiceConfig, order []string) []*reloadStep {
+	olds := make(map[string]PluginConfig)
+	for _, pc := range s.config.Plugins {
+		olds[pc.InstanceName()] = pc
+	}
+	news := make(map[string]PluginConfig)
+	for _, pc := range conf.Plugins {
+		news[pc.InstanceName()] = pc
+	}
+	steps := make([]*reloadStep, 0)
+	for _, name := range order {
+		pc := news[name]
+		old, ok := olds[name]
+		switch {
+		case !ok:
+			steps = append(steps, &reloadStep{name: name, action: ReloadAdded, new: pc})
+		case reflect.DeepEqual(old, pc):
+		case onlyConfChanged(old, pc):
+			steps = append(steps, &reloadStep{name: name, action: ReloadReconfigured, old: old, new: pc})
+		default:
+			steps = append(steps, &reloadStep{name: name, action: ReloadRestarted, old: old, new: pc})
+		}
+	}
+	// plugins unloaded already aren't in order
+	removed := make([]string, 0)
+	for name := range olds {
+		if _, ok := news[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		for j, name := range removed {
+			if name == s.order[i] {
+				steps = append(steps, &reloadStep{name: name, action: ReloadRemoved, old: olds[name]})
+				removed = append(removed[:j], removed[j+1:]...)
+				break
+			}
+		}
+	}
+	for _, name := range removed {
+		steps = append(steps, &reloadStep{name: name, action: ReloadRemoved, old: olds[name]})
+	}
+	return steps
+}
+
+//onlyConfChanged reports whether new differs from old only in config of plugin
+func onlyConfChanged(old, new PluginConfig) bool {
+	old.ConfMap = new.ConfMap
+	return reflect.DeepEqual(old, new)
+}
+
+//applyStep make the change of step, a plugin couldn't be reconfigured is restarted
+func (s *Service) applyStep(step *reloadStep) error {
+	switch step.action {
+	case ReloadAdded:
+		return s.addPlugin(step.new)
+	case ReloadRemoved:
+		if _, ok := s.mailboxes[step.name]; !ok {
+			// unloaded already
+			return nil
+		}
+		return s.UnloadPlugin(step.name)
+	case ReloadReconfigured:
+		ok, err := s.reconfigurePlugin(step.new)
+		if ok {
+			return err
+		}
+		s.logger.Info("plugin %s can't be reconfigured, restarting it", step.name)
+		step.action = ReloadRestarted
+	}
+	return s.replacePlugin(step.old, step.new)
+}
+
+//rollback undo steps in reverse order, so plugins run with their configs before reload,
+//plugins are removed after the others are changed so they're never rolled back
+func (s *Service) rollback(steps []*reloadStep, results map[string]*ReloadResult) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		s.logger.Info("Rolling back plugin %s %s", step.name, step.action)
+		var err error
+		switch step.action {
+		case ReloadAdded:
+			if _, ok := s.mailboxes[step.name]; ok {
+				err = s.UnloadPlugin(step.name)
+			}
+		case ReloadReconfigured:
+			_, err = s.reconfigurePlugin(step.old)
+		case ReloadRestarted:
+			err = s.replacePlugin(step.new, step.old)
+		}
+		if err != nil {
+			s.logger.Error("failed to roll back plugin %s: %v", step.name, err)
+			continue
+		}
+		results[step.name].RolledBack = true
+	}
+}
+
+//reconfigurePlugin apply config of pc to the running plugin,
+//it returns false if plugin isn't running or isn't a Reconfigurer
+func (s *Service) reconfigurePlugin(pc PluginConfig) (bool, error) {
+	name := pc.InstanceName()
+	pl, ok := s.Plugins[name]
+	if !ok {
+		return false, nil
+	}
+	rc, ok := pl.(Reconfigurer)
+	if !ok {
+		return false, nil
+	}
+	s.logger.Info("Reconfiguring plugin %s", name)
+	ctx := context.WithValue(context.Background(), CtxKeyConfig, pc.Config())
+	err := rc.Reconfigure(ctx)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return true, wrapError(err, "failed to reconfigure plugin %s", name)
+	}
+	// restarts and scheduled runs use the new config
+	s.pluginConfigs[name] = pc
+	s.logger.Info("Reconfigured plugin %s", name)
+	return true, nil
+}
+
+//replacePlugin restart plugin running with old config with new one. Plugin is
+//reloaded with a new mailbox if its schedule or chan config changed, msgs queued
+//for it are dropped then.
+func (s *Service) replacePlugin(old, new PluginConfig) error {
+	name := new.InstanceName()
+	if !sameMailbox(old, new) || old.Schedule != "" || new.Schedule != "" {
+		if _, ok := s.mailboxes[name]; ok {
+			err := s.UnloadPlugin(name)
+			if err != nil {
+				s.logger.Error("%v", err)
+			}
+		}
+		err := s.addPlugin(new)
+		if err != nil {
+			return wrapError(err, "failed to reload plugin %s", name)
+		}
+		return nil
+	}
+	return s.RestartPlugin(new)
+}
+
+func sameMailbox(old, new PluginConfig) bool {
+	return old.ChanLength == new.ChanLength && old.Overflow == new.Overflow &&
+		old.BlockTimeout == new.BlockTimeout && reflect.DeepEqual(old.Lanes, new.Lanes)
+}
@@ -0,0 +1,281 @@
+package elsvc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	watchInterval   = 500 * time.Millisecond
+	maxConnFailures = 3  // polls of a failed conn before plugin process is killed
+	stderrTailLines = 20 // stderr lines of plugin process kept for crash events
+)
+
+var errRunnerStopped = errors.New("plugin runner is stopped")
+
+//stderrTail keeps the last lines written to it
+type stderrTail struct {
+	mut     sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newStderrTail(max int) *stderrTail {
+	return &stderrTail{max: max, lines: make([]string, 0, max)}
+}
+
+func (s *stderrTail) Write(p []byte) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if line := string(bytes.TrimRight(data[:i], "\r")); line != "" {
+			s.lines = append(s.lines, line)
+		}
+		data = data[i+1:]
+	}
+	if len(s.lines) > s.max {
+		s.lines = append(s.lines[:0:0], s.lines[len(s.lines)-s.max:]...)
+	}
+	s.partial = append(s.partial[:0:0], data...)
+	return len(p), nil
+}
+
+//Lines returns a copy of lines kept
+func (s *stderrTail) Lines() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+//watch polls plugin process and its conn until ctx is done,
+//chanHandler is notified when the process exits
+func (s *pluginRunner) watch(ctx context.Context) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mut.Lock()
+		if s.stopping {
+			s.mut.Unlock()
+			return
+		}
+		client := s.pluginClient
+		s.mut.Unlock()
+		if client.Exited() {
+			failures = 0
+			s.notifyCrash()
+			continue
+		}
+		if s.unreachable() {
+			failures++
+		} else {
+			failures = 0
+		}
+		if failures >= maxConnFailures {
+			// process is alive but unreachable, kill it to respawn
+			s.logger.Error("conn to plugin %s keeps failing, killing plugin process", s.Name())
+			failures = 0
+			client.Kill()
+			s.notifyCrash()
+		}
+	}
+}
+
+//unreachable reports whether conn to plugin process failed
+func (s *pluginRunner) unreachable() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.stopping || s.conn == nil {
+		return false
+	}
+	switch s.conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return true
+	}
+	return false
+}
+
+func (s *pluginRunner) notifyCrash() {
+	select {
+	case s.crashed <- struct{}{}:
+	default:
+	}
+}
+
+//exited reports whether plugin process exited without Stop
+func (s *pluginRunner) exited() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return !s.stopping && s.pluginClient.Exited()
+}
+
+//waitExited waits for plugin process to exit in timeout, a msg may fail
+//while the process is exiting
+func (s *pluginRunner) waitExited(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !s.exited() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+//crashError describes how plugin process exited
+func (s *pluginRunner) crashError() *MsgError {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	status := "unknown"
+	code := -1
+	if s.cmd != nil && s.cmd.ProcessState != nil {
+		status = s.cmd.ProcessState.String()
+		code = s.cmd.ProcessState.ExitCode()
+	}
+	merr := NewError(ErrCodeUnavailable, "plugin process of %s crashed: %s", s.Name(), status).
+		WithDetail("plugin", s.Name()).
+		WithDetail("exit_status", status).
+		WithDetail("exit_code", code).
+		WithDetail("stderr", s.stderr.Lines())
+	merr.Retryable = true
+	return merr
+}
+
+//respawn report the crash of plugin process, then relaunch it as long as
+//supervisor of plugin allows, see handleRespawnMsg. It returns false if plugin
+//process is given up, service is told with MsgStartError then.
+func (s *pluginRunner) respawn(ctx context.Context) bool {
+	if !s.waitExited(watchInterval) {
+		if !s.unreachable() {
+			// notified already
+			return true
+		}
+		// process is dying or hung, make sure it's gone
+		s.mut.Lock()
+		client := s.pluginClient
+		s.mut.Unlock()
+		client.Kill()
+	}
+	crash := s.crashError()
+	s.logger.Error("%v, stderr: %v", crash, crash.Details["stderr"])
+	err := Publish(ctx, TopicPluginEvents, MsgPluginCrashed, crash.Details)
+	if err != nil {
+		s.logger.Error("failed to publish crash of plugin %s: %v", s.Name(), err)
+	}
+	restarts := 0
+	for {
+		backoff, n, err := s.askRespawn(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			s.logger.Error("giving up plugin %s: %v", s.Name(), err)
+			s.giveUp(ctx, crash)
+			return false
+		}
+		restarts = n
+		s.logger.Info("respawning plugin %s in %v", s.Name(), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		err = s.relaunch()
+		if err == nil {
+			break
+		}
+		if err == errRunnerStopped {
+			return false
+		}
+		s.logger.Error("failed to respawn plugin %s: %v", s.Name(), err)
+	}
+	s.logger.Info("respawned plugin %s", s.Name())
+	err = Publish(ctx, TopicPluginEvents, MsgPluginRespawned, map[string]interface{}{
+		"plugin":   s.Name(),
+		"restarts": restarts,
+	})
+	if err != nil {
+		s.logger.Error("failed to publish respawn of plugin %s: %v", s.Name(), err)
+	}
+	return true
+}
+
+//askRespawn ask service whether plugin process is respawned, it returns the
+//backoff before respawn and restarts of plugin in its restart window
+func (s *pluginRunner) askRespawn(ctx context.Context) (time.Duration, int, error) {
+	msg := NewMsg(ChanKeyService, MsgRespawnPlugin)
+	msg.SetRequest(map[string]interface{}{"start_id": s.startID})
+	resp, err := Request(ctx, msg)
+	if err != nil {
+		return 0, 0, err
+	}
+	backoff, _ := resp["backoff"].(string)
+	d, err := time.ParseDuration(backoff)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid backoff %q: %v", backoff, err)
+	}
+	restarts, _ := resp["restarts"].(int)
+	return d, restarts, nil
+}
+
+//relaunch run plugin binary again, then init and start it. The lock is held
+//only to swap plugin process, Stop isn't blocked by the rpcs.
+func (s *pluginRunner) relaunch() error {
+	s.mut.Lock()
+	if s.stopping {
+		s.mut.Unlock()
+		return errRunnerStopped
+	}
+	chanRPC := s.chanRPC
+	client := s.pluginClient
+	s.mut.Unlock()
+	// clean up the dead process
+	if chanRPC != nil {
+		chanRPC.Stop()
+	}
+	client.Kill()
+	err := s.launch()
+	if err != nil {
+		return err
+	}
+	err = s.init()
+	if err == nil {
+		err = s.start()
+	}
+	if err != nil {
+		s.mut.Lock()
+		client := s.pluginClient
+		s.mut.Unlock()
+		client.Kill()
+		return err
+	}
+	return nil
+}
+
+//giveUp tells service plugin is gone as if its Start returned with err
+func (s *pluginRunner) giveUp(ctx context.Context, err error) {
+	msg := NewMsg(ChanKeyService, MsgStartError)
+	msg.SetResponse(map[string]interface{}{
+		"plugin":   s.Name(),
+		"start_id": s.startID,
+		"error":    err,
+	})
+	SendMsg(ctx, msg)
+}
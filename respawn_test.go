@@ -0,0 +1,95 @@
+package elsvc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+//testPing returns pid of the plugin process replying ping
+func testPing(svcChan chan interface{}, pluginName string) (int, error) {
+	resp, err := testRequest(svcChan, NewMsg(pluginName, "ping"))
+	if err != nil {
+		return 0, err
+	}
+	pid, ok := resp["pid"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("invalid pong %+v", resp)
+	}
+	return int(pid), nil
+}
+
+func testCrash(svcChan chan interface{}, pluginName string) {
+	crash := NewMsg(pluginName, "crash")
+	crash.MsgFrom = "test"
+	svcChan <- crash
+}
+
+func TestRespawnSharesRestartBudget(t *testing.T) {
+	dir := testPluginDir(t, "echo.so")
+	defer os.RemoveAll(dir)
+	svcChan, _, stop := runService(t, fmt.Sprintf(`
+log_level: info
+plugin_mode: hcplugin
+plugins:
+  - type: echo
+    plugin_path: %s
+    restart: on-failure
+    max_restarts: 1
+`, dir))
+	defer stop()
+	pid, err := testPing(svcChan, "echo")
+	if err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+
+	// respawned process gets the msgs held meanwhile
+	testCrash(svcChan, "echo")
+	var respawned int
+	waitFor(t, 10*time.Second, "respawn of echo", func() bool {
+		respawned, err = testPing(svcChan, "echo")
+		return err == nil
+	})
+	if respawned == pid {
+		t.Fatalf("ping is replied by process %d crashed", pid)
+	}
+
+	// the respawn used up the restart of echo, supervisor doesn't restart it again
+	testCrash(svcChan, "echo")
+	waitFor(t, 10*time.Second, "echo to fail", func() bool {
+		return testState(t, svcChan, "echo") == StateFailed
+	})
+	time.Sleep(5 * minRestartBackoff)
+	if state := testState(t, svcChan, "echo"); state != StateFailed {
+		t.Errorf("echo is %s, want it to stay failed", state)
+	}
+}
+
+func TestRespawnRestartNever(t *testing.T) {
+	dir := testPluginDir(t, "echo.so")
+	defer os.RemoveAll(dir)
+	svcChan, _, stop := runService(t, fmt.Sprintf(`
+log_level: info
+plugin_mode: hcplugin
+plugins:
+  - type: echo
+    plugin_path: %s
+`, dir))
+	defer stop()
+	if _, err := testPing(svcChan, "echo"); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	testCrash(svcChan, "echo")
+	waitFor(t, 10*time.Second, "echo to fail", func() bool {
+		return testState(t, svcChan, "echo") == StateFailed
+	})
+	// it's unloaded instead of being respawned, its mailbox is gone
+	stats, err := testRequest(svcChan, NewMsg(ChanKeyService, MsgChanStats))
+	if err != nil {
+		t.Fatalf("failed to get chan stats: %v", err)
+	}
+	if _, ok := stats["echo"]; ok {
+		t.Errorf("crashed echo is still loaded")
+	}
+}
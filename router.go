@@ -0,0 +1,107 @@
+package elsvc
+
+import (
+	"time"
+)
+
+const (
+	maxRouteRetries = 10
+	minRouteBackoff = 10 * time.Millisecond
+	maxRouteBackoff = 2 * time.Second
+)
+
+//parkedMsg is a msg whose target chan isn't ready yet
+type parkedMsg struct {
+	msg     MsgBase
+	retries int
+	retryAt time.Time
+}
+
+//routeMsg deliver msg to the chan of its target,
+//msg is parked if the target isn't ready yet
+func (s *Service) routeMsg(msg MsgBase) {
+	msg.DeTTL()
+	if msg.Expired() {
+		s.rejectMsg(msg, NewError(ErrCodeExpired, "msg %s to %s expired: ttl reached", msg.Type(), msg.To()))
+		return
+	}
+	if mb, ok := s.mailboxes[msg.To()]; ok {
+		s.logger.Debug("routing msg: %+v", msg)
+		s.deliverMsg(mb, msg)
+		return
+	}
+	s.parkMsg(msg, 0)
+}
+
+//deliverMsg put msg into mailbox of its target, msg is rejected if its lane is full
+//and overflow policy is reject
+func (s *Service) deliverMsg(mb *mailbox, msg MsgBase) {
+	err := mb.put(msg)
+	if err != nil {
+		s.logger.Error("rejecting msg from %s: %v", msg.From(), err)
+		msg.SetError(err)
+	}
+}
+
+//overflowDrop handles msg dropped by mailbox for overflow
+func (s *Service) overflowDrop(v interface{}, err error) {
+	s.logger.Error("dropping msg for overflow %+v: %v", v, err)
+	s.deadLetter(v, ChanKeyService, err.Error())
+	if msg, ok := v.(MsgBase); ok {
+		msg.SetError(err)
+	}
+}
+
+//parkMsg keep msg for a later retry with exponential backoff
+func (s *Service) parkMsg(msg MsgBase, retries int) {
+	if retries >= maxRouteRetries {
+		s.rejectMsg(msg, NewError(ErrCodeNotFound, "msg %s to %s undeliverable: plugin not available after %d retries",
+			msg.Type(), msg.To(), retries))
+		return
+	}
+	backoff := minRouteBackoff << uint(retries)
+	if backoff > maxRouteBackoff {
+		backoff = maxRouteBackoff
+	}
+	s.logger.Debug("channel not ready, retry in %v for msg: %+v", backoff, msg)
+	s.parked = append(s.parked, &parkedMsg{
+		msg:     msg,
+		retries: retries + 1,
+		retryAt: time.Now().Add(backoff),
+	})
+}
+
+//retryParked route parked msgs which are due
+func (s *Service) retryParked() {
+	now := time.Now()
+	parked := s.parked
+	s.parked = nil
+	for _, p := range parked {
+		if p.retryAt.After(now) {
+			s.parked = append(s.parked, p)
+			continue
+		}
+		if p.msg.DeadlineExceeded() {
+			s.rejectMsg(p.msg, NewError(ErrCodeTimeout, "msg %s to %s passed deadline while parked", p.msg.Type(), p.msg.To()))
+			continue
+		}
+		p.msg.DeTTL()
+		if p.msg.Expired() {
+			s.rejectMsg(p.msg, NewError(ErrCodeExpired, "msg %s to %s expired: ttl reached", p.msg.Type(), p.msg.To()))
+			continue
+		}
+		if mb, ok := s.mailboxes[p.msg.To()]; ok {
+			s.logger.Debug("routing parked msg: %+v", p.msg)
+			s.deliverMsg(mb, p.msg)
+			continue
+		}
+		s.parkMsg(p.msg, p.retries)
+	}
+}
+
+//rejectMsg drop msg and reply the error to its sender
+func (s *Service) rejectMsg(msg MsgBase, err error) {
+	s.logger.Error("dropping msg from %s: %v", msg.From(), err)
+	s.deadLetter(msg, ChanKeyService, err.Error())
+	msg.SetError(err)
+}
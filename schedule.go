@@ -0,0 +1,279 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//Overlap policies, what to do when a scheduled run is due while the previous one is running
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow" // runs share the running plugin, only in goplugin mode
+)
+
+const (
+	maxRunHistory = 50 // runs kept for each scheduled plugin
+	maxQueuedRuns = 10 // runs queued more than that are skipped
+)
+
+//RunRecord is a scheduled run of a job plugin
+type RunRecord struct {
+	ID          string    `json:"id"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	JobResult
+}
+
+//schedule runs a job plugin on its cron expression
+type schedule struct {
+	id      string // tells triggers of this schedule from the ones before
+	cron    *cronSchedule
+	expr    string
+	overlap string
+	next    time.Time
+	timer   *time.Timer
+	active  map[string]*RunRecord // runs by their start id
+	cancels map[string]context.CancelFunc
+	queue   []*RunRecord
+	history []*RunRecord // latest last
+}
+
+//schedulePolicy returns the validated schedule config of plugin, nil if it isn't scheduled
+func (s PluginConfig) schedulePolicy() (*cronSchedule, string, error) {
+	if s.Schedule == "" {
+		return nil, "", nil
+	}
+	cron, err := parseCron(s.Schedule)
+	if err != nil {
+		return nil, "", err
+	}
+	// e.g. 0 0 30 2 *, plugin would never run
+	if cron.next(time.Now()).IsZero() {
+		return nil, "", fmt.Errorf("cron expression %s never fires", s.Schedule)
+	}
+	overlap := s.Overlap
+	switch overlap {
+	case "":
+		overlap = OverlapSkip
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		return nil, "", fmt.Errorf("overlap %s is none of %s, %s, %s",
+			s.Overlap, OverlapSkip, OverlapQueue, OverlapAllow)
+	}
+	return cron, overlap, nil
+}
+
+//isScheduled reports whether plugin is run on a schedule instead of being started
+func (s *Service) isScheduled(pluginName string) bool {
+	return s.pluginConfigs[pluginName].Schedule != ""
+}
+
+//schedulePlugin run plugin on its schedule from now on
+func (s *Service) schedulePlugin(pluginName string) {
+	pc := s.pluginConfigs[pluginName]
+	cron, overlap, _ := pc.schedulePolicy()
+	s.schedules[pluginName] = &schedule{
+		id:      newMsgID(),
+		cron:    cron,
+		expr:    pc.Schedule,
+		overlap: overlap,
+		active:  make(map[string]*RunRecord),
+		cancels: make(map[string]context.CancelFunc),
+	}
+	s.logger.Info("Scheduled plugin %s on %s", pluginName, pc.Schedule)
+	s.scheduleNext(pluginName)
+}
+
+//scheduleNext set timer of the next run of plugin
+func (s *Service) scheduleNext(pluginName string) {
+	sc := s.schedules[pluginName]
+	sc.next = sc.cron.next(time.Now())
+	if sc.next.IsZero() {
+		s.logger.Error("schedule %s of plugin %s has no next run", sc.expr, pluginName)
+		return
+	}
+	msg := NewMsg(ChanKeyService, MsgRunScheduled)
+	msg.MsgFrom = ChanKeyService
+	msg.SetRequest(map[string]interface{}{
+		"name":        pluginName,
+		"schedule_id": sc.id,
+	})
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	sc.timer = time.AfterFunc(time.Until(sc.next), func() {
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	})
+}
+
+//unschedule stop the schedule of plugin and cancel its runs
+func (s *Service) unschedule(pluginName string) {
+	sc, ok := s.schedules[pluginName]
+	if !ok {
+		return
+	}
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	for _, cancel := range sc.cancels {
+		cancel()
+	}
+	delete(s.schedules, pluginName)
+}
+
+//handleRunMsg start a run of plugin when its schedule is due
+func (s *Service) handleRunMsg(msg MsgBase) {
+	pluginName, _ := msg.GetRequest()["name"].(string)
+	scheduleID, _ := msg.GetRequest()["schedule_id"].(string)
+	sc, ok := s.schedules[pluginName]
+	if !ok || sc.id != scheduleID {
+		// plugin is unloaded or rescheduled already
+		s.logger.Debug("skip outdated run of plugin %s", pluginName)
+		return
+	}
+	run := &RunRecord{
+		ID:          newMsgID(),
+		ScheduledAt: sc.next,
+		JobResult:   JobResult{Plugin: pluginName, Status: JobPending},
+	}
+	s.scheduleNext(pluginName)
+	s.addRun(sc, run)
+	if len(sc.active) == 0 || sc.overlap == OverlapAllow {
+		s.startRun(pluginName, run)
+		return
+	}
+	if sc.overlap == OverlapQueue && len(sc.queue) < maxQueuedRuns {
+		s.logger.Info("queue run of plugin %s, the previous one is running", pluginName)
+		sc.queue = append(sc.queue, run)
+		return
+	}
+	s.logger.Info("skip run of plugin %s, the previous one is running", pluginName)
+	run.Status = JobSkipped
+	run.Error = NewError(ErrCodeRejected, "previous run of plugin %s is running", pluginName)
+}
+
+//addRun add run to history of schedule, the oldest finished run is dropped if it's full
+func (s *Service) addRun(sc *schedule, run *RunRecord) {
+	sc.history = append(sc.history, run)
+	if len(sc.history) <= maxRunHistory {
+		return
+	}
+	for i, r := range sc.history {
+		if r.finished() {
+			sc.history = append(sc.history[:i], sc.history[i+1:]...)
+			return
+		}
+	}
+}
+
+//startRun run plugin, each run is a fresh Init/Start cycle unless another
+//run is running, the concurrent run shares the running plugin then
+func (s *Service) startRun(pluginName string, run *RunRecord) {
+	sc := s.schedules[pluginName]
+	s.logger.Info("Running plugin %s, scheduled at %v", pluginName, run.ScheduledAt)
+	run.start()
+	var startID string
+	var err error
+	if len(sc.active) == 0 {
+		err = s.runCycle(pluginName)
+		startID = s.startIDs[pluginName]
+	} else {
+		startID = newMsgID()
+		ctx, cancel := s.pluginContext(pluginName, startID)
+		sc.cancels[startID] = cancel
+		err = s.Plugins[pluginName].Start(ctx)
+	}
+	if err != nil {
+		s.logger.Error("failed to run plugin %s: %v", pluginName, err)
+		s.finishRun(sc, startID, run, err)
+		return
+	}
+	sc.active[startID] = run
+}
+
+//runCycle init and start plugin, it's reloaded if it ran before
+func (s *Service) runCycle(pluginName string) error {
+	if s.pluginState(pluginName) == StateInitialized {
+		return s.StartPlugin(pluginName)
+	}
+	return s.RestartPlugin(s.pluginConfigs[pluginName])
+}
+
+//runExited record run of plugin returned from Start, it returns false if
+//the start isn't a scheduled run
+func (s *Service) runExited(pluginName, startID string, err error) bool {
+	sc, ok := s.schedules[pluginName]
+	if !ok {
+		return false
+	}
+	run, ok := sc.active[startID]
+	if !ok {
+		return false
+	}
+	s.logger.Info("run of plugin %s returned: %v", pluginName, err)
+	s.finishRun(sc, startID, run, err)
+	if len(sc.active) != 0 {
+		return true
+	}
+	delete(s.ready, pluginName)
+	if err != nil {
+		s.failPlugin(pluginName, err)
+	} else {
+		s.mustSetState(pluginName, StateStopped, nil)
+	}
+	// start the queued run
+	if len(sc.queue) != 0 {
+		run := sc.queue[0]
+		sc.queue = sc.queue[1:]
+		s.startRun(pluginName, run)
+	}
+	return true
+}
+
+func (s *Service) finishRun(sc *schedule, startID string, run *RunRecord, err error) {
+	run.finish(err)
+	delete(sc.active, startID)
+	if cancel, ok := sc.cancels[startID]; ok {
+		cancel()
+		delete(sc.cancels, startID)
+	}
+}
+
+//runResult set result of the run of plugin, see SetJobResult
+func (s *Service) runResult(pluginName string, result map[string]interface{}) {
+	sc, ok := s.schedules[pluginName]
+	if !ok {
+		return
+	}
+	if run, ok := sc.active[s.startIDs[pluginName]]; ok {
+		run.Result = result
+		return
+	}
+	for _, run := range sc.active {
+		run.Result = result
+		return
+	}
+}
+
+//runHistory returns schedule and runs of plugin for listing
+func (s *Service) runHistory(pluginName string) map[string]interface{} {
+	sc := s.schedules[pluginName]
+	runs := make([]RunRecord, 0, len(sc.history))
+	for _, run := range sc.history {
+		runs = append(runs, *run)
+	}
+	history := map[string]interface{}{
+		"schedule": sc.expr,
+		"overlap":  sc.overlap,
+		"running":  len(sc.active),
+		"queued":   len(sc.queue),
+		"runs":     runs,
+	}
+	if !sc.next.IsZero() {
+		history["next_run"] = sc.next
+	}
+	return history
+}
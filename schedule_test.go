@@ -0,0 +1,204 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testSymbols is a goplugin opened in process
+type testSymbols map[string]plugin.Symbol
+
+func (s testSymbols) Lookup(symName string) (plugin.Symbol, error) {
+	symbol, ok := s[symName]
+	if !ok {
+		return nil, fmt.Errorf("symbol %s not found", symName)
+	}
+	return symbol, nil
+}
+
+//testJob is a scheduled plugin in goplugin mode, each run returns when it's released
+type testJob struct {
+	mut        sync.Mutex
+	running    int
+	maxRunning int
+	started    chan struct{}
+	release    chan error
+}
+
+func (s *testJob) ModuleName() string {
+	return "job"
+}
+
+func (s *testJob) Init(ctx context.Context) error {
+	return nil
+}
+
+func (s *testJob) Start(ctx context.Context) error {
+	s.mut.Lock()
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mut.Unlock()
+	defer func() {
+		s.mut.Lock()
+		s.running--
+		s.mut.Unlock()
+	}()
+	s.started <- struct{}{}
+	select {
+	case err := <-s.release:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (s *testJob) Stop(ctx context.Context) error {
+	return nil
+}
+
+//testScheduled returns a service with plugin job scheduled with overlap. Its
+//msgs are handled by tests, runs are triggered by tests instead of the timer.
+func testScheduled(t *testing.T, overlap string) (*Service, *testJob, func()) {
+	dir, err := ioutil.TempDir("", "elsvc-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "job.so"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := &testJob{started: make(chan struct{}, 10), release: make(chan error)}
+	open := openGoplugin
+	openGoplugin = func(path string) (symbolLookup, error) {
+		return testSymbols{SymbolPluginObj: job}, nil
+	}
+	s := testService(t, fmt.Sprintf(`
+log_level: info
+plugin_mode: goplugin
+plugins:
+  - type: job
+    plugin_path: %s
+    schedule: "@hourly"
+    overlap: %s
+`, dir, overlap))
+	if err := s.StartPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	return s, job, func() {
+		s.Stop()
+		openGoplugin = open
+		os.RemoveAll(dir)
+	}
+}
+
+//testRunDue handles the msg of a scheduled run of job
+func testRunDue(s *Service) {
+	msg := NewMsg(ChanKeyService, MsgRunScheduled)
+	msg.SetRequest(map[string]interface{}{
+		"name":        "job",
+		"schedule_id": s.schedules["job"].id,
+	})
+	s.handleMsg(msg)
+}
+
+//testRunStarted waits for a run of job to start
+func testRunStarted(t *testing.T, job *testJob) {
+	select {
+	case <-job.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run of job isn't started")
+	}
+}
+
+//testRunReturned release a run of job, and handles msgs of service until its return is handled
+func testRunReturned(t *testing.T, s *Service, job *testJob) {
+	job.release <- nil
+	for {
+		select {
+		case v := <-s.Chans[ChanKeyService]:
+			s.handleMsg(v)
+			if msg, ok := v.(MsgBase); ok && msg.Type() == MsgStartError {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("return of job isn't sent to service")
+		}
+	}
+}
+
+func testRunStatuses(s *Service) []string {
+	statuses := make([]string, 0)
+	for _, run := range s.runHistory("job")["runs"].([]RunRecord) {
+		statuses = append(statuses, run.Status)
+	}
+	return statuses
+}
+
+func TestScheduleOverlap(t *testing.T) {
+	tests := []struct {
+		overlap string
+		// statuses of two runs due at once, and after the first one returns
+		overlapped []string
+		returned   []string
+		concurrent int
+	}{
+		{overlap: OverlapSkip,
+			overlapped: []string{JobRunning, JobSkipped},
+			returned:   []string{JobSucceeded, JobSkipped},
+			concurrent: 1},
+		{overlap: OverlapQueue,
+			overlapped: []string{JobRunning, JobPending},
+			returned:   []string{JobSucceeded, JobRunning},
+			concurrent: 1},
+		{overlap: OverlapAllow,
+			overlapped: []string{JobRunning, JobRunning},
+			returned:   []string{JobSucceeded, JobRunning},
+			concurrent: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overlap, func(t *testing.T) {
+			s, job, cleanup := testScheduled(t, tt.overlap)
+			defer cleanup()
+			testRunDue(s)
+			testRunStarted(t, job)
+			testRunDue(s)
+			if tt.overlap == OverlapAllow {
+				testRunStarted(t, job)
+			}
+			if got := testRunStatuses(s); fmt.Sprint(got) != fmt.Sprint(tt.overlapped) {
+				t.Errorf("runs are %v while overlapped, want %v", got, tt.overlapped)
+			}
+
+			testRunReturned(t, s, job)
+			if tt.overlap == OverlapQueue {
+				// the queued run starts as the first one returns
+				testRunStarted(t, job)
+			}
+			if got := testRunStatuses(s); fmt.Sprint(got) != fmt.Sprint(tt.returned) {
+				t.Errorf("runs are %v after the first returns, want %v", got, tt.returned)
+			}
+			if tt.returned[1] == JobRunning {
+				testRunReturned(t, s, job)
+				if got := testRunStatuses(s); fmt.Sprint(got) != fmt.Sprint([]string{JobSucceeded, JobSucceeded}) {
+					t.Errorf("runs are %v after both return", got)
+				}
+			}
+			if state := s.pluginState("job"); state != StateStopped {
+				t.Errorf("job is %s after its runs, want %s", state, StateStopped)
+			}
+			job.mut.Lock()
+			defer job.mut.Unlock()
+			if job.maxRunning != tt.concurrent {
+				t.Errorf("%d runs of job ran at once, want %d", job.maxRunning, tt.concurrent)
+			}
+		})
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
@@ -16,8 +16,8 @@ import (
 
 const (
 	defaultChanLength = 1000
+	defaultMsgTTL     = 64
 	ChanKeyService    = "common"
-	minGoroutineNum   = 3 //1 for go-plugin, 1 for service, 1 for exitSignal
 )
 
 const (
@@ -35,13 +35,93 @@ const (
 	MsgUnloadPlugin = "unload_plugin"
 	MsgLoadPlugin   = "load_plugin"
 	MsgListPlugins  = "list_plugins"
+	MsgChanStats    = "chan_stats"
+	MsgPluginReady  = "plugin_ready"
+	MsgIntercept    = "intercept" // sent to interceptor plugins
+
+	MsgRestartPlugin = "restart_plugin"
+	// crashed plugin process asks supervisor to respawn it
+	MsgRespawnPlugin = "respawn_plugin"
+	MsgPluginHealth  = "plugin_health" // result of a health probe
+	MsgHealthStatus  = "health_status"
+	MsgJobResult     = "job_result"  // sent by job plugins, see SetJobResult
+	MsgJobTimeout    = "job_timeout" // jobs didn't finish in job_timeout
+	MsgRunScheduled  = "run_scheduled"
+	MsgListRuns      = "list_runs"    // schedules and run history of scheduled plugins
+	MsgWatchPlugin   = "watch_plugin" // poll plugin_path for a newer version
+	// verdict of interceptor plugin, routing of the msg resumes with it
+	MsgInterceptDone = "intercept_done"
+
+	// blue/green upgrade of plugin process, see upgradePlugin
+	MsgUpgradePlugin  = "upgrade_plugin"
+	MsgUpgradeStarted = "upgrade_started" // new version is loaded, inited and started
+	MsgUpgradeChecked = "upgrade_checked" // health of new version is probed
+	MsgUpgradeTimeout = "upgrade_timeout" // new version isn't ready in ready_timeout
+	MsgUpgradeDrained = "upgrade_drained" // old version is drained
+
+	// published on TopicPluginEvents
+	MsgPluginCrashed   = "plugin_crashed"
+	MsgPluginRespawned = "plugin_respawned"
+	MsgHealthChanged   = "health_changed"
+	MsgStateChanged    = "state_changed"
+	MsgPluginUpgraded  = "plugin_upgraded"
+
+	MsgSubscribe   = "subscribe"
+	MsgUnsubscribe = "unsubscribe"
+
+	MsgDeadLetter           = "dead_letter"
+	MsgListDeadLetters      = "list_dead_letters"
+	MsgPurgeDeadLetters     = "purge_dead_letters"
+	MsgRedeliverDeadLetters = "redeliver_dead_letters"
 )
 
 type PluginConfig struct {
 	Type      string                 `json:"type"`
+	Name      string                 `json:"name"` // instance name, default type, msgs are sent to it
 	PluginDir string                 `json:"plugin_path"`
+	Version   string                 `json:"version"` // e.g. ~1.4, ^2, =2.0.1 or >=1.2 <2, default latest
 	ConfMap   map[string]interface{} `json:"config"`
 	EnvMap    map[string]string      `json:"env"`
+	Kind      string                 `json:"kind"`  // empty or interceptor
+	Order     int                    `json:"order"` // order of interceptor
+	// plugins started before this one, and stopped after it
+	DependsOn    []string `json:"depends_on"`
+	WaitReady    bool     `json:"wait_ready"`    // dependents wait for it to call Ready
+	ReadyTimeout string   `json:"ready_timeout"` // e.g. 10s, default 30s
+	// supervision when Start returns in service mode
+	Restart       string `json:"restart"`        // never, on-failure or always
+	MaxRestarts   int    `json:"max_restarts"`   // in restart_window, default 5
+	RestartWindow string `json:"restart_window"` // e.g. 10m, default 1m
+	Escalation    string `json:"escalation"`     // fail_plugin or stop_service
+	// in-chan of plugin, see mailbox
+	ChanLength   int          `json:"chan_length"`
+	Overflow     string       `json:"overflow"`      // reject, block, drop_oldest or drop_newest
+	BlockTimeout string       `json:"block_timeout"` // e.g. 500ms, for overflow block
+	Lanes        []LaneConfig `json:"lanes"`
+	StopTimeout  string       `json:"stop_timeout"` // e.g. 5s, default 10s, plugin is killed after that
+	// health probing, plugin is restarted if it fails health_threshold probes in a row
+	HealthInterval  string `json:"health_interval"`  // e.g. 10s, no probing by default
+	HealthTimeout   string `json:"health_timeout"`   // e.g. 1s, default 5s
+	HealthThreshold int    `json:"health_threshold"` // default 3
+	// in job mode, plugin serves jobs and is stopped when they finish
+	Daemon bool `json:"daemon"`
+	// in service mode, plugin is run as a job on a cron expression instead of being started
+	Schedule string `json:"schedule"` // e.g. */5 * * * *, @hourly or @every 30s
+	Overlap  string `json:"overlap"`  // skip, queue or allow, default skip
+	// hex sha256 of plugin binary, <binary>.sha256 is checked if it's not set.
+	// It pins the binary, plugin with it can't be watched or upgraded.
+	SHA256 string `json:"sha256"`
+	// in service mode with hcplugin, running plugin is upgraded to a newer <plugin>.so.<version> found in plugin_path
+	Watch         bool   `json:"watch"`
+	WatchInterval string `json:"watch_interval"` // e.g. 1m, default 10s
+}
+
+//InstanceName returns the name plugin is loaded and addressed as
+func (s PluginConfig) InstanceName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Type
 }
 
 func (s PluginConfig) PluginPath() string {
@@ -58,27 +138,63 @@ func (s PluginConfig) Config() map[string]interface{} {
 	return s.ConfMap
 }
 
-// func (s PluginConfig) ChanLen() int {
-// 	// TODO should I make it default to 1?
-// 	if s.ChanLength == 0 {
-// 		return defaultChanLength
-// 	}
-// 	return s.ChanLength
-// }
+//mailboxConfig returns the validated in-chan config of plugin
+func (s PluginConfig) mailboxConfig() (mailboxConfig, error) {
+	return newMailboxConfig(s.Lanes, s.ChanLength, s.Overflow, s.BlockTimeout)
+}
 
 type ServiceConfig struct {
 	LogLevel   string         `json:"log_level"`
 	PluginMode string         `json:"plugin_mode"`
 	RunMode    string         `json:"run_mode"`
+	ChanLength int            `json:"chan_length"` // length of service chan
 	Plugins    []PluginConfig `json:"plugins"`
+	// e.g. 1m, default 30s, for all plugins to stop
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// in job mode, jobs not finished in job_timeout are stopped, no limit by default
+	JobTimeout string `json:"job_timeout"`
+	JobSummary string `json:"job_summary"` // file to write job summary to, - for stdout
+	// plugin binaries must have sha256 in config or <binary>.sha256
+	VerifyPlugins bool `json:"verify_plugins"`
+	// ed25519 public keys in hex or base64, plugin binaries must have
+	// a <binary>.sig signed by one of them if it's set
+	TrustedKeys []string `json:"trusted_keys"`
 }
 
 type Service struct {
 	LoadedPlugins map[string]PluginLoaderIntf // since plugin couldn't unload, reload plugin will lookup here
 	Plugins       map[string]PluginLoaderIntf
 	Chans         map[string]chan interface{}
+	mailboxes     map[string]*mailbox // plugin -> lanes feeding its chan
 	cancelFuncs   map[string]context.CancelFunc
+	parked        []*parkedMsg // msgs wait for their target chan
+	deadLetters   *deadLetterQueue
+	topics        map[string]map[string]bool // topic -> subscribers
+	interceptors  interceptorChain
+	// msgs waiting for interceptor plugins, see askInterceptor
+	intercepts    map[string]*pendingIntercept
+	order         []string                // plugins sorted by dependencies
+	pluginConfigs map[string]PluginConfig // configs of loaded plugins
+	ready         map[string]bool         // plugins are running
+	startErrs     map[string]error        // plugins returned from start
+	startIDs      map[string]string       // id of the latest start of plugins
+	supervised    map[string]*supervisorState
+	states        map[string]*pluginStatus // lifecycle of plugins, kept after they're unloaded
+	health        map[string]*healthStatus
+	jobs          map[string]*JobResult // job plugins in job mode
+	jobsStarted   time.Time
+	schedules     map[string]*schedule // scheduled plugins
+	watches       map[string]*watch    // plugins watched for new versions
+	upgrades      map[string]*upgrade  // blue/green upgrades in progress
+	done          chan struct{}        // closed when service stops
+	stopOnce      sync.Once
+	stopped       chan struct{} // closed when Start returns
+	stopDeadline  time.Time     // plugins must stop before it while service is stopping
+	forced        chan struct{} // closed to kill plugins stopping
+	forceOnce     sync.Once
 	config        *ServiceConfig
+	configPath    string // config file is reloaded from, see MsgConfigReload
+	verifier      *verifier
 	logger        *Logger
 }
 
@@ -105,108 +221,265 @@ func (s *Service) LoadConfig(configPath string) error {
 			return fmt.Errorf("env CONFIGPATH is empty")
 		}
 	}
-	data, err := ioutil.ReadFile(configPath)
+	confObj, order, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	err = logger.SetLogLevel(confObj.LogLevel)
 	if err != nil {
+		logger.Error("failed to set logLevel to %s: %v", confObj.LogLevel, err)
 		return err
 	}
+	s.configPath = configPath
+	s.config = confObj
+	s.order = order
+	s.verifier, _ = confObj.verifier()
+	return nil
+}
+
+//readConfig read and validate config file, it returns the config and its plugins sorted by dependencies
+func readConfig(configPath string) (*ServiceConfig, []string, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
 	confObj := &ServiceConfig{}
 	err = yaml.Unmarshal(data, confObj)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	//pluginMode
 	if confObj.PluginMode == "" {
 		confObj.PluginMode = "goplugin"
 	}
 	if confObj.PluginMode != PluginModeGO && confObj.PluginMode != PluginModeHC {
-		return fmt.Errorf("Plugin mode %s is neither %s nor %s", confObj.PluginMode, PluginModeGO, PluginModeHC)
+		return nil, nil, fmt.Errorf("Plugin mode %s is neither %s nor %s", confObj.PluginMode, PluginModeGO, PluginModeHC)
 	}
 	//runMode
 	if confObj.RunMode == "" {
 		confObj.RunMode = RunModeSvc
 	}
 	if confObj.RunMode != RunModeSvc && confObj.RunMode != RunModeJob {
-		return fmt.Errorf("Run mode %s is neither %s nor %s", confObj.RunMode, RunModeSvc, RunModeJob)
+		return nil, nil, fmt.Errorf("Run mode %s is neither %s nor %s", confObj.RunMode, RunModeSvc, RunModeJob)
 	}
 	//logLevel
 	if confObj.LogLevel == "" {
 		confObj.LogLevel = LogDebugLevel
 	}
-	err = logger.SetLogLevel(confObj.LogLevel)
+	if confObj.LogLevel != LogDebugLevel && confObj.LogLevel != LogInfoLevel {
+		return nil, nil, fmt.Errorf("invalid logLevel %s", confObj.LogLevel)
+	}
+	//shutdownTimeout
+	if _, err := confObj.shutdownTimeout(); err != nil {
+		return nil, nil, err
+	}
+	//jobTimeout
+	if _, err := confObj.jobTimeout(); err != nil {
+		return nil, nil, err
+	}
+	//trustedKeys
+	if _, err := confObj.verifier(); err != nil {
+		return nil, nil, err
+	}
+	//plugin order
+	order, err := sortPlugins(confObj.Plugins)
 	if err != nil {
-		logger.Error("failed to set logLevel to %s: %v", confObj.LogLevel, err)
-		return err
+		return nil, nil, err
 	}
-	s.config = confObj
-	return nil
+	return confObj, order, nil
 }
 
 func (s *Service) InitPlugin(pc PluginConfig) error {
 	// init plugin
-	s.logger.Info("Initing plugin %s", pc.Type)
+	name := pc.InstanceName()
+	s.logger.Info("Initing plugin %s", name)
+	err := s.checkState(name, StateInitialized)
+	if err != nil {
+		return err
+	}
 	ctx := context.WithValue(
 		context.Background(), CtxKeyConfig, pc.Config())
-	pl := s.Plugins[pc.Type]
-	err := pl.Init(ctx)
+	pl := s.Plugins[name]
+	err = pl.Init(ctx)
 	if err != nil {
+		s.mustSetState(name, StateFailed, err)
 		return err
 	}
-	s.logger.Info("Inited plugin %s", pc.Type)
+	s.mustSetState(name, StateInitialized, nil)
+	s.logger.Info("Inited plugin %s", name)
 	return nil
 }
 
 func (s *Service) LoadPlugin(pc PluginConfig) (PluginLoaderIntf, error) {
-	pluginPath := findLatestSO(pc.Type, pc.PluginPath())
-	if pluginPath == "" {
-		return nil, fmt.Errorf("failed to find plugin %s in %s", pc.Type, pc.PluginPath())
+	name := pc.InstanceName()
+	// e.g. plugin is running already
+	err := s.checkState(name, StateLoaded)
+	if err != nil {
+		return nil, err
+	}
+	mbConf, err := s.validatePlugin(pc)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkDepends(pc)
+	if err != nil {
+		return nil, err
+	}
+	pluginPath, err := pc.findSO()
+	if err != nil {
+		return nil, err
 	}
 	s.logger.Info("Loading plugin %s", pluginPath)
 	var pl PluginLoaderIntf
 	switch s.config.PluginMode {
 	case PluginModeGO:
+		// each instance is a separate object
+		loadedKey := pluginPath
+		if name != pc.Type {
+			loadedKey = pluginPath + "#" + name
+		}
 		// if plugin loaded
-		if _, ok := s.LoadedPlugins[pluginPath]; ok {
-			pl = s.LoadedPlugins[pluginPath]
+		if _, ok := s.LoadedPlugins[loadedKey]; ok {
+			pl = s.LoadedPlugins[loadedKey]
 		} else {
 			// plugin not loaded yet
-			pl = &pluginLoader{}
+			pl = s.newLoader()
 			err := pl.Load(pc)
 			if err != nil {
 				return nil, err
 			}
-			s.LoadedPlugins[pluginPath] = pl
-			// make sure ModuleName is equal with type parsed in
-			if pl.Name() != pc.Type {
-				return nil, fmt.Errorf("ModuleName %s != plugin type %s", pl.Name(), pc.Type)
-			}
+			s.LoadedPlugins[loadedKey] = pl
 		}
 	case PluginModeHC:
-		pl = &pluginRunner{}
+		// each instance runs in its own process
+		pl = s.newLoader()
 		err := pl.Load(pc)
 		if err != nil {
 			return nil, err
 		}
-		// make sure ModuleName is equal with type parsed in
-		if pl.Name() != pc.Type {
-			return nil, fmt.Errorf("ModuleName %s != plugin type %s", pl.Name(), pc.Type)
+	}
+	s.mustSetState(name, StateLoaded, nil)
+	st := s.states[name]
+	st.pluginType = pc.Type
+	st.path = pluginPath
+	st.version = soVersion(pluginPath)
+	st.mode = s.config.PluginMode
+	st.kind = pc.Kind
+	st.meta = pl.Meta()
+	s.Plugins[name] = pl
+	// msgs are queued in lanes, chan only passes the one picked
+	s.Chans[name] = s.GetChan(name, 0)
+	// mailbox is kept when plugin restarts
+	if _, ok := s.mailboxes[name]; !ok {
+		mb := newMailbox(name, mbConf, s.Chans[name], s.overflowDrop)
+		s.mailboxes[name] = mb
+		go mb.run()
+	}
+	s.pluginConfigs[name] = pc
+	s.addToOrder(name)
+	// scheduled plugin runs the latest version each time
+	if pc.Schedule == "" {
+		s.watchPlugin(name)
+	}
+	if pc.Kind == PluginKindInterceptor {
+		err := s.interceptors.add(interceptor{name: name, order: pc.Order, plugin: true})
+		if err != nil {
+			return nil, err
 		}
 	}
-	s.Plugins[pl.Name()] = pl
-	s.Chans[pl.Name()] = s.GetChan(pl.Name(), defaultChanLength)
-	s.logger.Info("Loaded plugin %s", pl.Name())
+	s.logger.Info("Loaded plugin %s", name)
 	return pl, nil
 }
 
+//validatePlugin check config of plugin before it's loaded, it returns the in-chan config of plugin
+func (s *Service) validatePlugin(pc PluginConfig) (mailboxConfig, error) {
+	name := pc.InstanceName()
+	if name == ChanKeyService || isTopic(name) {
+		return mailboxConfig{}, fmt.Errorf("plugin name %s is reserved", name)
+	}
+	mbConf, err := pc.mailboxConfig()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid chan config of plugin %s", name)
+	}
+	_, err = parseConstraint(pc.Version)
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid version of plugin %s", name)
+	}
+	_, err = pc.checksum()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid sha256 of plugin %s", name)
+	}
+	if pc.Kind != "" && pc.Kind != PluginKindInterceptor {
+		return mbConf, fmt.Errorf("kind %s of plugin %s isn't %s", pc.Kind, name, PluginKindInterceptor)
+	}
+	_, err = pc.restartPolicy()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid restart policy of plugin %s", name)
+	}
+	_, err = pc.stopTimeout()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid config of plugin %s", name)
+	}
+	_, err = pc.healthConfig()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid health config of plugin %s", name)
+	}
+	_, overlap, err := pc.schedulePolicy()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid schedule of plugin %s", name)
+	}
+	if pc.Schedule != "" && s.config.RunMode != RunModeSvc {
+		return mbConf, fmt.Errorf("plugin %s is scheduled but run mode isn't %s", name, RunModeSvc)
+	}
+	_, err = pc.watchInterval()
+	if err != nil {
+		return mbConf, errors.Wrapf(err, "invalid watch config of plugin %s", name)
+	}
+	if pc.Watch && s.config.RunMode != RunModeSvc {
+		return mbConf, fmt.Errorf("plugin %s is watched but run mode isn't %s", name, RunModeSvc)
+	}
+	// other versions wouldn't match the sha256
+	if pc.Watch && pc.SHA256 != "" {
+		return mbConf, fmt.Errorf("plugin %s is watched but its sha256 pins the binary, use %s sidecars instead", name, checksumExt)
+	}
+	// a .so can't be opened next to another version of it
+	if pc.Watch && s.config.PluginMode != PluginModeHC {
+		return mbConf, fmt.Errorf("plugin %s is watched but plugin mode isn't %s", name, PluginModeHC)
+	}
+	// instances of a goplugin share the env of service process
+	if len(pc.EnvMap) != 0 && name != pc.Type && s.config.PluginMode == PluginModeGO {
+		return mbConf, fmt.Errorf("named instance %s sets env but plugin mode is %s, use config instead", name, PluginModeGO)
+	}
+	// a process serves one start at a time
+	if overlap == OverlapAllow && s.config.PluginMode != PluginModeGO {
+		return mbConf, fmt.Errorf("overlap %s of plugin %s needs plugin mode %s", OverlapAllow, name, PluginModeGO)
+	}
+	return mbConf, nil
+}
+
+//newLoader returns a loader of plugin mode, binaries are verified before they're loaded
+func (s *Service) newLoader() PluginLoaderIntf {
+	if s.config.PluginMode == PluginModeHC {
+		return &pluginRunner{verifier: s.verifier}
+	}
+	return &pluginLoader{verifier: s.verifier}
+}
+
 func (s *Service) LoadPlugins() error {
 	s.logger.Info("loading plugins...")
+	configs := make(map[string]PluginConfig)
 	for _, pc := range s.config.Plugins {
+		configs[pc.InstanceName()] = pc
+	}
+	for _, name := range s.order {
+		pc := configs[name]
 		_, err := s.LoadPlugin(pc)
 		if err != nil {
-			return errors.Wrapf(err, "failed load plugin %s", pc.Type)
+			return errors.Wrapf(err, "failed load plugin %s", name)
 		}
 		err = s.InitPlugin(pc)
 		if err != nil {
-			return errors.Wrapf(err, "failed init plugin %s", pc.Type)
+			return errors.Wrapf(err, "failed init plugin %s", name)
 		}
 	}
 	return nil
@@ -219,9 +492,25 @@ func (s *Service) Init(configPath string) error {
 	s.LoadedPlugins = make(map[string]PluginLoaderIntf)
 	s.Plugins = make(map[string]PluginLoaderIntf)
 	s.cancelFuncs = make(map[string]context.CancelFunc)
-	// init default chan
+	s.deadLetters = newDeadLetterQueue(defaultDeadLetterSize)
+	s.topics = make(map[string]map[string]bool)
 	s.Chans = make(map[string]chan interface{})
-	s.GetChan(ChanKeyService, defaultChanLength)
+	s.mailboxes = make(map[string]*mailbox)
+	s.pluginConfigs = make(map[string]PluginConfig)
+	s.ready = make(map[string]bool)
+	s.startErrs = make(map[string]error)
+	s.startIDs = make(map[string]string)
+	s.supervised = make(map[string]*supervisorState)
+	s.states = make(map[string]*pluginStatus)
+	s.health = make(map[string]*healthStatus)
+	s.jobs = make(map[string]*JobResult)
+	s.schedules = make(map[string]*schedule)
+	s.watches = make(map[string]*watch)
+	s.upgrades = make(map[string]*upgrade)
+	s.intercepts = make(map[string]*pendingIntercept)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	s.forced = make(chan struct{})
 
 	// load config
 	err = s.LoadConfig(configPath)
@@ -229,6 +518,13 @@ func (s *Service) Init(configPath string) error {
 		return err
 	}
 
+	// init default chan
+	chanLength := s.config.ChanLength
+	if chanLength <= 0 {
+		chanLength = defaultChanLength
+	}
+	s.GetChan(ChanKeyService, chanLength)
+
 	s.logger.Info("pluginMode: %s", s.config.PluginMode)
 	s.logger.Info("logLevel: %s", s.config.LogLevel)
 
@@ -242,195 +538,394 @@ func (s *Service) Init(configPath string) error {
 
 func (s *Service) StartPlugin(pluginName string) error {
 	s.logger.Info("Starting plugin %s", pluginName)
+	// e.g. plugin is started twice
+	err := s.setState(pluginName, StateStarting, nil)
+	if err != nil {
+		return err
+	}
 	pl := s.Plugins[pluginName]
-	ctx := context.WithValue(context.Background(), CtxKeyInchan, s.Chans[pluginName])
-	ctx = context.WithValue(ctx, CtxKeyOutchan, s.Chans[ChanKeyService])
-	ctx, cancel := context.WithCancel(ctx)
+	// tells exit of this start from the ones before
+	s.startIDs[pluginName] = newMsgID()
+	ctx, cancel := s.pluginContext(pluginName, s.startIDs[pluginName])
 	s.cancelFuncs[pluginName] = cancel
-	err := pl.Start(ctx)
+	delete(s.ready, pluginName)
+	delete(s.startErrs, pluginName)
+	err = pl.Start(ctx)
 	if err != nil {
+		s.mustSetState(pluginName, StateFailed, err)
 		return err
 	}
+	if !s.pluginConfigs[pluginName].WaitReady {
+		s.ready[pluginName] = true
+		s.mustSetState(pluginName, StateRunning, nil)
+	}
+	s.startProbe(ctx, pluginName, pl)
 	s.logger.Info("Started plugin %s", pluginName)
 	return nil
 }
 
+//addPlugin load, init and start plugin, or schedule it if it's scheduled
+func (s *Service) addPlugin(pc PluginConfig) error {
+	_, err := s.LoadPlugin(pc)
+	if err != nil {
+		return err
+	}
+	err = s.InitPlugin(pc)
+	if err != nil {
+		return err
+	}
+	if s.isScheduled(pc.InstanceName()) {
+		s.schedulePlugin(pc.InstanceName())
+		return nil
+	}
+	return s.StartPlugin(pc.InstanceName())
+}
+
+//pluginContext returns ctx to start plugin with, its exit is told by startID
+func (s *Service) pluginContext(pluginName, startID string) (context.Context, context.CancelFunc) {
+	return s.pluginContextOn(pluginName, startID, s.Chans[pluginName])
+}
+
+//pluginContextOn returns ctx to start plugin with, reading msgs from inChan
+func (s *Service) pluginContextOn(pluginName, startID string, inChan chan interface{}) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), CtxKeyInchan, inChan)
+	ctx = context.WithValue(ctx, CtxKeyOutchan, s.Chans[ChanKeyService])
+	ctx = context.WithValue(ctx, CtxKeyName, pluginName)
+	ctx = context.WithValue(ctx, CtxKeyStartID, startID)
+	return context.WithCancel(ctx)
+}
+
 func (s *Service) StartPlugins() error {
 	s.logger.Info("Starting Plugins")
-	for ptype := range s.Plugins {
-		err := s.StartPlugin(ptype)
+	for _, ptype := range s.order {
+		if _, ok := s.Plugins[ptype]; !ok {
+			continue
+		}
+		skipped, err := s.waitDepends(ptype)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start plugin %s", ptype)
+			return err
 		}
-		// if in job mode, wait for start return msg
-		if s.config.RunMode == RunModeJob {
-			select {
-			case v := <-s.Chans[ChanKeyService]:
-				msg, ok := v.(MsgBase)
-				if !ok {
-					return fmt.Errorf("failed to convert msg %+v", v)
-				}
-				switch msg.Type() {
-				case MsgStartError:
-					err := msg.GetResponse()["error"].(error)
-					if err != nil {
-						return err
-					}
-				default:
-					return fmt.Errorf("waiting MsgStartError but got %+v", err)
-				}
-			}
+		if skipped {
+			continue
+		}
+		if s.isScheduled(ptype) {
+			s.schedulePlugin(ptype)
+			continue
+		}
+		err = s.StartPlugin(ptype)
+		if s.isJob(ptype) {
+			// a job failed to start doesn't stop others
+			s.jobStarted(ptype, err)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to start plugin %s", ptype)
 		}
-
 	}
 	return nil
 }
 
-func (s *Service) signalHandler() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		for sig := range c {
-			s.logger.Debug("Receive signal %+v", sig)
-			if sig.String() != os.Interrupt.String() {
-				continue
+//waitDepends wait for plugins ptype depends on to be ready, or to finish if
+//they're jobs. It returns true if job ptype is skipped as a job failed.
+func (s *Service) waitDepends(ptype string) (bool, error) {
+	for _, dep := range s.pluginConfigs[ptype].DependsOn {
+		if s.isScheduled(dep) {
+			// it runs on its schedule
+			continue
+		}
+		if !s.isJob(dep) {
+			err := s.waitReady(dep)
+			if err != nil {
+				return false, err
 			}
-			s.UnloadPlugins()
-			os.Exit(1)
+			continue
 		}
-	}()
-}
-
-func (s *Service) startJobMode() error {
-	return nil
+		ok, err := s.waitJob(dep)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			continue
+		}
+		if !s.isJob(ptype) {
+			return false, NewError(ErrCodeUnavailable, "plugin %s depends on job %s which didn't succeed", ptype, dep)
+		}
+		s.skipJob(ptype, dep)
+		return true, nil
+	}
+	return false, nil
 }
 
 func (s *Service) Start() error {
-	// run pluginsjob
 	// start worker for kill signal
-	go s.signalHandler()
+	defer close(s.stopped)
+	go s.signalHandler(s.Chans[ChanKeyService])
 	// run in job mode
-	// if s.config.RunMode == RunModeJob {
-	// 	s.logger.Info("Start service at job mode")
-	// 	return s.startJobMode()
-	// }
+	if s.config.RunMode == RunModeJob {
+		s.logger.Info("Start service at job mode")
+		return s.startJobMode()
+	}
 	// run in service mode
 	s.logger.Info("Start service at service mode")
 	err := s.StartPlugins()
+	if err == errServiceStopped {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	return s.serve()
+}
+
+//serve handle msgs until service is stopped
+func (s *Service) serve() error {
+	_, err := s.serveUntil(nil, nil)
+	return err
+}
+
+//serveUntil route msgs until cond returns true or an error, cond is checked
+//before each msg and when wake fires. It returns true if service is stopped
+//meanwhile, with the error stopping it.
+func (s *Service) serveUntil(cond func() (bool, error), wake <-chan time.Time) (bool, error) {
+	retryTicker := time.NewTicker(minRouteBackoff)
+	defer retryTicker.Stop()
 	for {
+		if cond != nil {
+			if ok, err := cond(); ok || err != nil {
+				return false, err
+			}
+		}
+		// only wake up for retry when there are parked msgs
+		var retryChan <-chan time.Time
+		if len(s.parked) != 0 {
+			retryChan = retryTicker.C
+		}
 		select {
+		case <-wake:
+		case <-retryChan:
+			s.retryParked()
 		case v := <-s.Chans[ChanKeyService]:
-			// check if received a message
-			msg, ok := v.(MsgBase)
-			if !ok {
-				s.logger.Error("dropping invalid msg %+v", v)
-				continue
-			}
-			// message sent to service for routing
-			if msg.To() != ChanKeyService {
-				// route message to corresponding chan
-				if _, ok := s.Chans[msg.To()]; ok {
-					s.logger.Debug("routing msg: %+v", msg)
-					s.Chans[msg.To()] <- msg
-					continue
-				}
-				if msg.To() == "" {
-					s.logger.Error("dropping invalid msg %+v", v)
-					continue
-				}
-				// channel not ready yet for this message
-				// put msg back to queue
-				// msg.DeTTL()
-				// if msg.Expired() {
-				// 	// reach ttl EOL
-				// 	// drop msg
-				// 	s.logger.Info("drop eol message %v", msg)
-				// 	continue
-				// }
-				//TODO should I directly drop message?
-				s.logger.Debug("channel not ready for msg: %+v", msg)
-				s.Chans[ChanKeyService] <- msg
+			if stop, err := s.handleMsg(v); stop {
+				return true, err
 			}
+		}
+	}
+}
 
-			// message sent to controller itself
-			switch msg.Type() {
-			case MsgTypeStop:
-				s.logger.Info("Received stop msg, stopping service")
-				if v, ok := msg.GetRequest()["error"]; ok && v != nil {
-					s.logger.Debug("Stop msg with an error: %v", v.(error))
-				}
-				// if force stop
-				if v, ok := msg.GetRequest()["force"]; ok && v.(bool) {
-					s.logger.Info("Force quit, Exit...")
-					if v, ok := msg.GetRequest()["error"]; ok && v != nil {
-						os.Exit(1)
-					}
-					os.Exit(0)
-				}
-				// soft stop
-				err := s.Stop()
-				msg.SetResponse(map[string]interface{}{"error": err})
-				waitGoroutines(minGoroutineNum)
-				return msg.GetError()
-			case MsgUnloadPlugin:
-				pluginName := msg.GetRequest()["name"].(string)
-				err := s.UnloadPlugin(pluginName)
-				msg.SetResponse(map[string]interface{}{"error": err})
-			case MsgListPlugins:
-				resp := make(map[string]interface{})
-				for pluginName := range s.Plugins {
-					resp[pluginName] = true
-				}
-				msg.SetResponse(resp)
-			case MsgLoadPlugin:
-				pc := PluginConfig{}
-				data, _ := json.Marshal(msg.GetRequest())
-				err := json.Unmarshal(data, &pc)
-				if err != nil {
-					msg.SetResponse(map[string]interface{}{"error": err})
-				}
-				// LoadConfig(msg.GetRequest()["PluginConfig"], &pc)
-				// pc := msg.GetRequest()["PluginConfig"].(PluginConfig)
-				_, err = s.LoadPlugin(pc)
-				if err != nil {
-					msg.SetResponse(map[string]interface{}{"error": err})
-				}
-				err = s.InitPlugin(pc)
-				if err != nil {
-					msg.SetResponse(map[string]interface{}{"error": err})
-				}
-				err = s.StartPlugin(pc.Type)
-				if err != nil {
-					msg.SetResponse(map[string]interface{}{"error": err})
-				}
-				msg.SetResponse(map[string]interface{}{"error": nil})
-			}
-			// default:
-			// 	logrus.Errorf("received invalid msg %+v", v)
-			// }
-		} // end select
-	} // end for
+//admitMsg route msg sent by plugins, it's checked and passed to interceptors first
+func (s *Service) admitMsg(msg MsgBase) {
+	// reject payload doesn't match its registered type
+	if err := validatePayload(msg); err != nil {
+		s.rejectMsg(msg, err)
+		return
+	}
+	s.interceptMsg(msg, nil)
+}
+
+//handleMsg route msg received by service, or handle it if it's a control msg.
+//It returns true if service is stopped, or all jobs are finished in job mode.
+func (s *Service) handleMsg(v interface{}) (bool, error) {
+	msg, ok := v.(MsgBase)
+	if !ok {
+		s.logger.Error("dropping invalid msg %+v", v)
+		s.deadLetter(v, ChanKeyService, "invalid msg")
+		return false, nil
+	}
+	// requester gave up already
+	if msg.DeadlineExceeded() {
+		s.logger.Debug("dropping msg passed deadline: %+v", msg)
+		s.deadLetter(msg, ChanKeyService, "deadline exceeded")
+		msg.SetError(newTimeoutError(msg, context.DeadlineExceeded))
+		return false, nil
+	}
+	// message sent to service for routing
+	if msg.To() != ChanKeyService {
+		if msg.To() == "" {
+			s.logger.Error("dropping invalid msg %+v", v)
+			s.deadLetter(msg, ChanKeyService, "msg without target")
+			return false, nil
+		}
+		s.admitMsg(msg)
+		return false, nil
+	}
+
+	// message sent to controller itself
+	switch msg.Type() {
+	case MsgTypeStop:
+		s.logger.Info("Received stop msg, stopping service")
+		reqErr := msg.GetRequestError()
+		if reqErr != nil {
+			s.logger.Debug("Stop msg with an error: %v", reqErr)
+		}
+		// force stop kills plugins without waiting for them
+		if force, ok := msg.GetRequest()["force"].(bool); ok && force {
+			s.logger.Info("Force stop, killing plugins")
+			s.forceStop()
+		}
+		err := s.Stop()
+		msg.SetResponse(map[string]interface{}{"error": err})
+		if err == nil {
+			// service exits with the error stopping it
+			err = reqErr
+		}
+		return true, err
+	case MsgPluginReady:
+		startID, _ := msg.GetRequest()["start_id"].(string)
+		if s.upgradeReady(msg.From(), startID) {
+			return false, nil
+		}
+		s.logger.Info("plugin %s is ready", msg.From())
+		s.ready[msg.From()] = true
+		if s.pluginState(msg.From()) == StateStarting {
+			s.mustSetState(msg.From(), StateRunning, nil)
+		}
+	case MsgStartError:
+		pluginName, _ := msg.GetResponse()["plugin"].(string)
+		startID, _ := msg.GetResponse()["start_id"].(string)
+		err := msg.GetError()
+		if s.upgradeExited(pluginName, startID, err) {
+			return false, nil
+		}
+		// scheduled runs aren't supervised
+		if s.runExited(pluginName, startID, err) {
+			return false, nil
+		}
+		if startID != s.startIDs[pluginName] {
+			// plugin is unloaded or restarted already
+			s.logger.Debug("skip exit of outdated start of plugin %s", pluginName)
+			return false, nil
+		}
+		s.logger.Info("plugin %s returned from start: %v", pluginName, err)
+		delete(s.ready, pluginName)
+		s.startErrs[pluginName] = err
+		if err != nil {
+			s.failPlugin(pluginName, err)
+		} else {
+			s.mustSetState(pluginName, StateStopped, nil)
+		}
+		if s.isJob(pluginName) {
+			s.jobExited(pluginName, err)
+			return s.jobsDone(), nil
+		}
+		return s.pluginExited(pluginName, err)
+	case MsgJobResult:
+		if job, ok := s.jobs[msg.From()]; ok {
+			job.Result = msg.GetRequest()
+		} else {
+			s.runResult(msg.From(), msg.GetRequest())
+		}
+	case MsgJobTimeout:
+		timeout, _ := msg.GetRequest()["timeout"].(string)
+		s.logger.Error("jobs didn't finish in %s, stopping service", timeout)
+		return true, NewError(ErrCodeTimeout, "jobs didn't finish in %s", timeout)
+	case MsgRestartPlugin:
+		s.handleRestartMsg(msg)
+	case MsgRespawnPlugin:
+		s.handleRespawnMsg(msg)
+	case MsgRunScheduled:
+		s.handleRunMsg(msg)
+	case MsgWatchPlugin:
+		s.handleWatchMsg(msg)
+	case MsgInterceptDone:
+		s.handleInterceptDone(msg)
+	case MsgUpgradeStarted, MsgUpgradeChecked, MsgUpgradeTimeout, MsgUpgradeDrained:
+		s.handleUpgradeMsg(msg)
+	case MsgListRuns:
+		resp := make(map[string]interface{})
+		for pluginName := range s.schedules {
+			resp[pluginName] = s.runHistory(pluginName)
+		}
+		msg.SetResponse(resp)
+	case MsgPluginHealth:
+		return s.handleHealthMsg(msg)
+	case MsgHealthStatus:
+		resp := make(map[string]interface{})
+		for pluginName := range s.Plugins {
+			resp[pluginName] = s.healthStatus(pluginName)
+		}
+		msg.SetResponse(resp)
+	case MsgUnloadPlugin:
+		pluginName := msg.GetRequest()["name"].(string)
+		err := s.UnloadPlugin(pluginName)
+		msg.SetResponse(map[string]interface{}{"error": err})
+	case MsgSubscribe, MsgUnsubscribe:
+		s.handleTopicMsg(msg)
+	case MsgDeadLetter, MsgListDeadLetters, MsgPurgeDeadLetters, MsgRedeliverDeadLetters:
+		s.handleDeadLetterMsg(msg)
+	case MsgChanStats:
+		resp := make(map[string]interface{})
+		for pluginName, mb := range s.mailboxes {
+			resp[pluginName] = mb.stats()
+		}
+		msg.SetResponse(resp)
+	case MsgListPlugins:
+		resp := make(map[string]interface{})
+		for pluginName := range s.states {
+			resp[pluginName] = s.statusOf(pluginName)
+		}
+		msg.SetResponse(resp)
+	case MsgLoadPlugin:
+		pc := PluginConfig{}
+		data, _ := json.Marshal(msg.GetRequest())
+		err := json.Unmarshal(data, &pc)
+		if err != nil {
+			msg.SetResponse(map[string]interface{}{"error": err})
+			return false, nil
+		}
+		// LoadConfig(msg.GetRequest()["PluginConfig"], &pc)
+		// pc := msg.GetRequest()["PluginConfig"].(PluginConfig)
+		err = s.addPlugin(pc)
+		msg.SetResponse(map[string]interface{}{"error": err})
+	case MsgUpgradePlugin:
+		// replied when upgrade ends
+		err := s.requestUpgrade(&msg)
+		if err != nil {
+			msg.SetResponse(map[string]interface{}{"error": err})
+		}
+	case MsgConfigReload:
+		// config file service started with by default
+		configPath, _ := msg.GetRequest()["path"].(string)
+		results, err := s.reloadConfig(configPath)
+		msg.SetResponse(map[string]interface{}{"error": err, "plugins": results})
+	}
+	return false, nil
 }
 
 func (s *Service) UnloadPlugin(pluginType string) error {
 	s.logger.Info("Unloading plugin %s", pluginType)
-	if _, ok := s.Plugins[pluginType]; !ok {
-		return fmt.Errorf("failed to unload plugin %s: %s not found ", pluginType, pluginType)
-	}
-	pl := s.Plugins[pluginType]
-	// send cancel to start
-	s.logger.Info("Send cancel message to plugin %s", pluginType)
-	s.cancelFuncs[pluginType]()
-	// run plugin stop
-	s.logger.Info("Stopping plugin %s", pluginType)
-	err := pl.Stop(context.Background())
-	if err != nil {
-		return errors.Wrapf(err, "failed to stop plugin %s", pluginType)
+	pl, loaded := s.Plugins[pluginType]
+	if _, ok := s.mailboxes[pluginType]; !ok {
+		return NewError(ErrCodeNotFound, "failed to unload plugin %s: %s not found", pluginType, pluginType)
+	}
+	for _, name := range s.dependents(pluginType) {
+		if _, ok := s.Plugins[name]; ok {
+			s.logger.Error("unloading plugin %s while plugin %s depends on it", pluginType, name)
+		}
+	}
+	prevState := s.pluginState(pluginType)
+	s.mustSetState(pluginType, StateStopping, nil)
+	s.unschedule(pluginType)
+	s.unwatch(pluginType)
+	s.cancelUpgrade(pluginType)
+	var stopErr error
+	// plugin isn't loaded if its restart failed
+	if loaded {
+		// send cancel to start
+		s.logger.Info("Send cancel message to plugin %s", pluginType)
+		if cancel, ok := s.cancelFuncs[pluginType]; ok {
+			cancel()
+		}
+		// run plugin stop
+		s.logger.Info("Stopping plugin %s", pluginType)
+		err := s.stopPlugin(pluginType, pl)
+		if err != nil {
+			// clean up anyway, plugin is cancelled already
+			s.logger.Error("failed to stop plugin %s: %v", pluginType, err)
+			stopErr = wrapError(err, "failed to stop plugin %s", pluginType)
+		} else {
+			s.logger.Info("Stopped plugin %s", pluginType)
+		}
 	}
-	s.logger.Info("Stopped plugin %s", pluginType)
 	// delete pluginMap
 	delete(s.Plugins, pluginType)
 	// delete loadedpluginMap if in hashicorp mode
@@ -442,29 +937,62 @@ func (s *Service) UnloadPlugin(pluginType string) error {
 		}
 	}
 	// delete chan
+	s.mailboxes[pluginType].close()
+	for _, v := range s.mailboxes[pluginType].drain() {
+		s.overflowDrop(v, NewError(ErrCodeUnavailable, "plugin %s is unloaded", pluginType))
+	}
+	delete(s.mailboxes, pluginType)
 	close(s.Chans[pluginType])
 	delete(s.Chans, pluginType)
 	// delete cancel
 	delete(s.cancelFuncs, pluginType)
+	// delete subscriptions
+	s.unsubscribeAll(pluginType)
+	s.RemoveInterceptor(pluginType)
+	s.removeFromOrder(pluginType)
+	delete(s.pluginConfigs, pluginType)
+	delete(s.ready, pluginType)
+	delete(s.startErrs, pluginType)
+	delete(s.startIDs, pluginType)
+	delete(s.supervised, pluginType)
+	delete(s.health, pluginType)
+	// failed plugin stays failed
+	if stopErr != nil || prevState == StateFailed {
+		s.mustSetState(pluginType, StateFailed, stopErr)
+	} else {
+		s.mustSetState(pluginType, StateStopped, nil)
+	}
 	s.logger.Info("Unloaded plugin %s", pluginType)
-	return nil
+	return stopErr
 }
 
+//UnloadPlugins unload plugins in reverse order of dependencies,
+//all plugins are unloaded even if some fail, the first error is returned
 func (s *Service) UnloadPlugins() error {
-	for ptype := range s.Plugins {
+	var firstErr error
+	order := append([]string{}, s.order...)
+	for i := len(order) - 1; i >= 0; i-- {
+		ptype := order[i]
+		if _, ok := s.mailboxes[ptype]; !ok {
+			continue
+		}
 		err := s.UnloadPlugin(ptype)
-		if err != nil {
-			return errors.Wrapf(err, "failed unload plugin %s", ptype)
+		if err != nil && firstErr == nil {
+			firstErr = wrapError(err, "failed unload plugin %s", ptype)
 		}
 	}
-	return nil
+	return firstErr
 }
 
+//Stop unload all plugins within shutdown_timeout,
+//plugins miss their stop deadline are killed
 func (s *Service) Stop() error {
+	// no more scheduled restarts
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
 	// stop all plugins
-	err := s.UnloadPlugins()
-	if err != nil {
-		return err
-	}
-	return nil
+	err := s.shutdown()
+	s.verifier.cleanup()
+	return err
 }
@@ -0,0 +1,184 @@
+package elsvc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// test binary is the plugin binary of tests in hcplugin mode
+	conf := HandshakeConf()
+	if os.Getenv(conf.MagicCookieKey) == conf.MagicCookieValue {
+		StartPlugin(&testPlugin{})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+//testPlugin is run by the test binary as plugin echo, it replies ping with
+//pid of its process, crashes the process on crash, and returns from Start
+//with the error in request on return. Its binary named
+//slow, broken or unhealthy inits slowly, fails to init or isn't healthy.
+type testPlugin struct{}
+
+func (s *testPlugin) ModuleName() string {
+	return "echo"
+}
+
+func (s *testPlugin) Init(ctx context.Context) error {
+	name := filepath.Base(os.Args[0])
+	if strings.Contains(name, "slow") {
+		time.Sleep(time.Second)
+	}
+	if strings.Contains(name, "broken") {
+		return NewError(ErrCodeRejected, "%s is broken", name)
+	}
+	return nil
+}
+
+func (s *testPlugin) Health(ctx context.Context) error {
+	name := filepath.Base(os.Args[0])
+	if strings.Contains(name, "unhealthy") {
+		return NewError(ErrCodeUnavailable, "%s is unhealthy", name)
+	}
+	return nil
+}
+
+func (s *testPlugin) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case v := <-InChan(ctx):
+			msg, ok := v.(MsgBase)
+			if !ok {
+				continue
+			}
+			switch msg.Type() {
+			case "ping":
+				msg.SetResponse(map[string]interface{}{
+					"pid":     os.Getpid(),
+					"version": soVersion(os.Args[0]),
+				})
+			case "crash":
+				os.Stderr.WriteString("crashing on purpose\n")
+				os.Exit(3)
+			case "return":
+				return msg.GetRequestError()
+			}
+		}
+	}
+}
+
+func (s *testPlugin) Stop(ctx context.Context) error {
+	return nil
+}
+
+//testService returns a service initialized with config, its plugins aren't started
+func testService(t *testing.T, config string) *Service {
+	f, err := ioutil.TempFile("", "elsvc-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	s := &Service{}
+	if err := s.Init(f.Name()); err != nil {
+		t.Fatalf("failed to init service: %v", err)
+	}
+	return s
+}
+
+//testPluginDir returns a plugin_path with the test binary linked as
+//the hcplugin binaries named, remove it when test is done
+func testPluginDir(t *testing.T, names ...string) string {
+	dir, err := ioutil.TempDir("", "elsvc-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		linkTestPlugin(t, dir, name)
+	}
+	return dir
+}
+
+func linkTestPlugin(t *testing.T, dir, name string) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(exe, filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//runService starts service with config, it returns the service chan to
+//talk to service, the result of Start, and a func stopping service
+func runService(t *testing.T, config string) (chan interface{}, <-chan error, func()) {
+	s := testService(t, config)
+	// s.Chans is changed by service from now on
+	svcChan := s.Chans[ChanKeyService]
+	exited := make(chan error, 1)
+	go func() {
+		exited <- s.Start()
+	}()
+	return svcChan, exited, func() {
+		select {
+		case <-s.stopped:
+			return
+		default:
+		}
+		stop := NewMsg(ChanKeyService, MsgTypeStop)
+		stop.MsgFrom = "test"
+		svcChan <- stop
+		select {
+		case <-s.stopped:
+		case <-time.After(10 * time.Second):
+			t.Error("service isn't stopped in 10s")
+		}
+	}
+}
+
+//testRequest send msg to service as plugin test, and wait for its response
+func testRequest(svcChan chan interface{}, msg MsgBase) (map[string]interface{}, error) {
+	ctx := context.WithValue(context.Background(), CtxKeyOutchan, svcChan)
+	ctx = context.WithValue(ctx, CtxKeyName, "test")
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return Request(ctx, msg)
+}
+
+//testStatus returns status of plugin listed by service
+func testStatus(t *testing.T, svcChan chan interface{}, pluginName string) map[string]interface{} {
+	resp, err := testRequest(svcChan, NewMsg(ChanKeyService, MsgListPlugins))
+	if err != nil {
+		t.Fatalf("failed to list plugins: %v", err)
+	}
+	status, _ := resp[pluginName].(map[string]interface{})
+	return status
+}
+
+//testState returns state of plugin listed by service
+func testState(t *testing.T, svcChan chan interface{}, pluginName string) PluginState {
+	state, _ := testStatus(t, svcChan, pluginName)["state"].(string)
+	return PluginState(state)
+}
+
+//waitFor polls cond until it returns true, it fails the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
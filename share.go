@@ -3,7 +3,9 @@ package elsvc
 import (
 	context "context"
 	"encoding/json"
+	"errors"
 	fmt "fmt"
+	"strings"
 
 	"github.com/hashicorp/go-plugin"
 )
@@ -49,19 +51,74 @@ func StartPlugin(pl PluginIntf) error {
 }
 
 func NewMsg(msgTo, msgType string) MsgBase {
+	id := newMsgID()
 	msg := MsgBase{
-		MsgTo:       msgTo,
-		MsgType:     msgType,
-		MsgRequest:  make(map[string]interface{}),
-		MsgResponse: make(chan map[string]interface{}, 1),
-		TTL:         64,
+		MsgId:         id,
+		CorrelationId: id,
+		MsgTo:         msgTo,
+		MsgType:       msgType,
+		MsgRequest:    make(map[string]interface{}),
+		MsgResponse:   make(chan map[string]interface{}, 1),
+		TTL:           defaultMsgTTL,
 	}
 	return msg
 }
 
+//SendMsg send msg to service, it fails with a timeout MsgError
+//if ctx is done before service chan has room
 func SendMsg(ctx context.Context, msg interface{}) error {
-	OutChan(ctx) <- msg
-	return nil
+	if m, ok := msg.(MsgBase); ok {
+		msg = stampMsg(ctx, m)
+	}
+	// service chan may be full, don't block after ctx is done
+	select {
+	case OutChan(ctx) <- msg:
+		return nil
+	case <-ctx.Done():
+		return NewError(ErrCodeTimeout, "failed to send msg %+v: %v", msg, ctx.Err()).WithCause(ctx.Err())
+	}
+}
+
+//stampMsg set sender of msg to the plugin running with ctx,
+//and make msg a child of the parent msg in ctx if there is one
+func stampMsg(ctx context.Context, msg MsgBase) MsgBase {
+	if msg.MsgFrom == "" {
+		msg.MsgFrom = PluginName(ctx)
+	}
+	if parent, ok := ctx.Value(CtxKeyParent).(MsgBase); ok && msg.isRoot() {
+		msg.inherit(parent)
+	}
+	return msg
+}
+
+//WithParent returns a ctx, msgs sent with it are derived from parent.
+//Use it when handling a msg, so the msgs sent for it can be traced back.
+func WithParent(ctx context.Context, parent MsgBase) context.Context {
+	return context.WithValue(ctx, CtxKeyParent, parent)
+}
+
+//Request send msg and wait for its response until ctx is done.
+//It returns the error in response if there is one,
+//or a MsgError with ErrCodeTimeout if ctx is done before response arrives.
+func Request(ctx context.Context, msg MsgBase) (map[string]interface{}, error) {
+	msg = stampMsg(ctx, msg)
+	msg.WantReply = true
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Deadline = deadline
+	}
+	if msg.MsgResponse == nil {
+		msg.MsgResponse = make(chan map[string]interface{}, 1)
+	}
+	select {
+	case OutChan(ctx) <- msg:
+	case <-ctx.Done():
+		return nil, newTimeoutError(msg, ctx.Err())
+	}
+	resp, err := msg.GetResponseContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resp, msg.GetError()
 }
 
 func OutChan(ctx context.Context) chan interface{} {
@@ -72,6 +129,44 @@ func InChan(ctx context.Context) chan interface{} {
 	return ctx.Value(CtxKeyInchan).(chan interface{})
 }
 
+//PluginName returns name of the plugin running with ctx
+func PluginName(ctx context.Context) string {
+	name, _ := ctx.Value(CtxKeyName).(string)
+	return name
+}
+
+//Topic returns the msg target of a topic, msg sent to it will be
+//copied to every subscriber of the topic
+func Topic(name string) string {
+	return TopicPrefix + strings.TrimPrefix(name, TopicPrefix)
+}
+
+//Subscribe let the plugin running with ctx receive msgs sent to topic
+func Subscribe(ctx context.Context, topic string) error {
+	msg := NewMsg(ChanKeyService, MsgSubscribe)
+	msg.SetRequest(map[string]interface{}{"topic": topic})
+	_, err := Request(ctx, msg)
+	return err
+}
+
+//Unsubscribe stop receiving msgs sent to topic
+func Unsubscribe(ctx context.Context, topic string) error {
+	msg := NewMsg(ChanKeyService, MsgUnsubscribe)
+	msg.SetRequest(map[string]interface{}{"topic": topic})
+	_, err := Request(ctx, msg)
+	return err
+}
+
+//Publish send a msg of msgType to every subscriber of topic
+func Publish(ctx context.Context, topic, msgType string, req map[string]interface{}) error {
+	msg := NewMsg(Topic(topic), msgType)
+	err := msg.SetRequest(req)
+	if err != nil {
+		return err
+	}
+	return SendMsg(ctx, msg)
+}
+
 func GetConfig(ctx context.Context) map[string]interface{} {
 	ret := make(map[string]interface{})
 	v := ctx.Value(CtxKeyConfig)
@@ -98,7 +193,10 @@ func LoadConfig(ctx context.Context, v interface{}) error {
 //Exit function for one time job, it will exit the application.
 func Exit(ctx context.Context) error {
 	msg := NewMsg(ChanKeyService, MsgTypeStop)
-	OutChan(ctx) <- msg
-	err := msg.GetError()
+	_, err := Request(ctx, msg)
+	if errors.Is(err, context.Canceled) {
+		// service cancels plugins while stopping
+		return nil
+	}
 	return err
 }
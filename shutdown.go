@@ -0,0 +1,173 @@
+package elsvc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	defaultStopTimeout     = 10 * time.Second
+	// wait for a plugin to be killed after it misses stop deadline
+	killGracePeriod = 3 * time.Second
+)
+
+//Exit codes of service, see ExitCode
+const (
+	ExitCodeOK      = 0
+	ExitCodeError   = 1
+	ExitCodeTimeout = 2 // plugins missed stop deadline and were killed, or startup timed out
+)
+
+//ExitCode returns the process exit code for err returned by Start
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitCodeOK
+	case IsTimeout(err):
+		return ExitCodeTimeout
+	}
+	return ExitCodeError
+}
+
+//shutdownTimeout returns the validated time for all plugins to stop
+func (s ServiceConfig) shutdownTimeout() (time.Duration, error) {
+	return parseTimeout("shutdown_timeout", s.ShutdownTimeout, defaultShutdownTimeout)
+}
+
+//stopTimeout returns the validated time for plugin to stop
+func (s PluginConfig) stopTimeout() (time.Duration, error) {
+	return parseTimeout("stop_timeout", s.StopTimeout, defaultStopTimeout)
+}
+
+func parseTimeout(key, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return def, fmt.Errorf("invalid %s %s", key, value)
+	}
+	return d, nil
+}
+
+//signalHandler stops service on SIGINT or SIGTERM,
+//plugins are killed at once if another signal comes while stopping,
+//and process exits at the third one, e.g. if the routing loop is stuck.
+//Stop msg is sent to svcChan, s.Chans is changed by the routing loop.
+func (s *Service) signalHandler(svcChan chan interface{}) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	signals := 0
+	done := s.done
+	// nil until there's a stop msg to send
+	var sendChan chan interface{}
+	var stopMsg interface{}
+	for {
+		select {
+		case sig := <-c:
+			signals++
+			switch signals {
+			case 1:
+				s.logger.Info("Receive signal %v, stopping service", sig)
+				msg := NewMsg(ChanKeyService, MsgTypeStop)
+				msg.MsgFrom = ChanKeyService
+				msg.SetRequest(map[string]interface{}{"signal": sig.String()})
+				stopMsg = msg
+				sendChan = svcChan
+			case 2:
+				s.logger.Error("Receive signal %v while stopping, killing plugins", sig)
+				s.forceStop()
+			default:
+				s.logger.Error("Receive signal %v again, exiting now", sig)
+				os.Exit(ExitCodeError)
+			}
+		// signals are still handled while the routing loop is busy
+		case sendChan <- stopMsg:
+			sendChan = nil
+		case <-done:
+			// service is stopping already
+			done = nil
+			sendChan = nil
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+//forceStop makes plugins stopping now killed without waiting for their deadline
+func (s *Service) forceStop() {
+	s.forceOnce.Do(func() {
+		close(s.forced)
+	})
+}
+
+//stopPlugin run Stop of plugin within its stop_timeout, and before the shutdown
+//deadline if service is stopping. Plugin missing the deadline is killed,
+//an in-process plugin is abandoned as it can't be killed.
+func (s *Service) stopPlugin(pluginName string, pl PluginLoaderIntf) error {
+	timeout, _ := s.pluginConfigs[pluginName].stopTimeout()
+	if !s.stopDeadline.IsZero() {
+		if left := time.Until(s.stopDeadline); left < timeout {
+			timeout = left
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.forced:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- pl.Stop(ctx)
+	}()
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			// plugin gave up on ctx, and it's killed if it's a process
+			return s.stopTimeoutError(pluginName, timeout, err)
+		}
+		return err
+	case <-ctx.Done():
+	}
+	// plugin ignores ctx, give it a moment to be killed
+	select {
+	case err := <-done:
+		return s.stopTimeoutError(pluginName, timeout, err)
+	case <-time.After(killGracePeriod):
+	}
+	s.logger.Error("plugin %s is still stopping, abandon it", pluginName)
+	return s.stopTimeoutError(pluginName, timeout, nil)
+}
+
+func (s *Service) stopTimeoutError(pluginName string, timeout time.Duration, err error) error {
+	merr := NewError(ErrCodeTimeout, "plugin %s didn't stop in %v", pluginName, timeout).
+		WithDetail("plugin", pluginName).
+		WithCause(err)
+	select {
+	case <-s.forced:
+		merr.Message = fmt.Sprintf("plugin %s is killed by force stop", pluginName)
+	default:
+	}
+	return merr
+}
+
+//shutdown unload all plugins before shutdown_timeout
+func (s *Service) shutdown() error {
+	timeout, _ := s.config.shutdownTimeout()
+	s.stopDeadline = time.Now().Add(timeout)
+	defer func() {
+		s.stopDeadline = time.Time{}
+	}()
+	s.logger.Info("Stopping plugins in %v", timeout)
+	return s.UnloadPlugins()
+}
@@ -0,0 +1,301 @@
+package elsvc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Restart policies, what to do when Start of plugin returns in service mode
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure" // restart if Start returns an error
+	RestartAlways    = "always"
+)
+
+//Escalations, what to do when plugin restarts too often
+const (
+	EscalateFailPlugin  = "fail_plugin" // unload plugin and mark it failed
+	EscalateStopService = "stop_service"
+)
+
+const (
+	defaultMaxRestarts   = 5
+	defaultRestartWindow = time.Minute
+	minRestartBackoff    = 100 * time.Millisecond
+	maxRestartBackoff    = 30 * time.Second
+)
+
+//restartPolicy is the validated supervision config of a plugin
+type restartPolicy struct {
+	restart     string
+	maxRestarts int
+	window      time.Duration
+	escalation  string
+}
+
+func (s PluginConfig) restartPolicy() (restartPolicy, error) {
+	policy := restartPolicy{
+		restart:     s.Restart,
+		maxRestarts: s.MaxRestarts,
+		window:      defaultRestartWindow,
+		escalation:  s.Escalation,
+	}
+	switch policy.restart {
+	case "":
+		policy.restart = RestartNever
+	case RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return policy, fmt.Errorf("restart %s is none of %s, %s, %s",
+			s.Restart, RestartNever, RestartOnFailure, RestartAlways)
+	}
+	if policy.maxRestarts < 0 {
+		return policy, fmt.Errorf("invalid max_restarts %d", s.MaxRestarts)
+	}
+	if policy.maxRestarts == 0 {
+		policy.maxRestarts = defaultMaxRestarts
+	}
+	if s.RestartWindow != "" {
+		d, err := time.ParseDuration(s.RestartWindow)
+		if err != nil || d <= 0 {
+			return policy, fmt.Errorf("invalid restart_window %s", s.RestartWindow)
+		}
+		policy.window = d
+	}
+	switch policy.escalation {
+	case "":
+		policy.escalation = EscalateFailPlugin
+	case EscalateFailPlugin, EscalateStopService:
+	default:
+		return policy, fmt.Errorf("escalation %s is neither %s nor %s",
+			s.Escalation, EscalateFailPlugin, EscalateStopService)
+	}
+	return policy, nil
+}
+
+//supervisorState tracks restarts of a plugin
+type supervisorState struct {
+	config    PluginConfig
+	restarts  []time.Time // restarts in window
+	restartID string      // id of the scheduled restart, empty if none
+}
+
+//supervisorOf returns supervisor state of plugin, restarts and respawns of
+//plugin are counted in it
+func (s *Service) supervisorOf(pluginName string, pc PluginConfig) *supervisorState {
+	state, ok := s.supervised[pluginName]
+	if !ok {
+		state = &supervisorState{}
+		s.supervised[pluginName] = state
+	}
+	state.config = pc
+	return state
+}
+
+//allowRestart count a restart in restart window, it returns the backoff
+//before the restart, or false if plugin restarted too many times
+func (s *supervisorState) allowRestart(policy restartPolicy) (time.Duration, bool) {
+	// forget restarts out of window
+	now := time.Now()
+	recent := make([]time.Time, 0, len(s.restarts))
+	for _, t := range s.restarts {
+		if now.Sub(t) < policy.window {
+			recent = append(recent, t)
+		}
+	}
+	s.restarts = recent
+	if len(s.restarts) >= policy.maxRestarts {
+		return 0, false
+	}
+	backoff := minRestartBackoff << uint(len(s.restarts))
+	if backoff > maxRestartBackoff || backoff <= 0 {
+		backoff = maxRestartBackoff
+	}
+	s.restarts = append(s.restarts, now)
+	return backoff, true
+}
+
+//pluginExited decide what to do when Start of plugin returns with err.
+//It returns true if service is stopped for escalation.
+func (s *Service) pluginExited(pluginName string, err error) (bool, error) {
+	pc, ok := s.pluginConfigs[pluginName]
+	if !ok {
+		return false, nil
+	}
+	policy, _ := pc.restartPolicy()
+	restart := policy.restart == RestartAlways || (policy.restart == RestartOnFailure && err != nil)
+	if !restart {
+		s.logger.Info("plugin %s exited with %v, restart policy is %s", pluginName, err, policy.restart)
+		uerr := s.UnloadPlugin(pluginName)
+		if uerr != nil {
+			s.logger.Error("failed to unload exited plugin %s: %v", pluginName, uerr)
+		}
+		return false, nil
+	}
+	s.logger.Info("plugin %s exited with %v", pluginName, err)
+	return s.scheduleRestart(pluginName, pc, policy, err)
+}
+
+//scheduleRestart restart plugin after backoff, or escalate if it restarted
+//too many times in restart window. It returns true if service is stopped.
+func (s *Service) scheduleRestart(pluginName string, pc PluginConfig, policy restartPolicy, err error) (bool, error) {
+	state := s.supervisorOf(pluginName, pc)
+	backoff, ok := state.allowRestart(policy)
+	if !ok {
+		return s.escalate(pluginName, policy, err)
+	}
+	state.restartID = newMsgID()
+	s.logger.Info("restart plugin %s %d/%d in %v",
+		pluginName, len(state.restarts), policy.maxRestarts, backoff)
+	msg := NewMsg(ChanKeyService, MsgRestartPlugin)
+	msg.MsgFrom = ChanKeyService
+	msg.SetRequest(map[string]interface{}{
+		"name":       pluginName,
+		"restart_id": state.restartID,
+	})
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	time.AfterFunc(backoff, func() {
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	})
+	return false, nil
+}
+
+//escalate handles plugin restarted too many times
+func (s *Service) escalate(pluginName string, policy restartPolicy, err error) (bool, error) {
+	s.logger.Error("plugin %s restarted %d times in %v, escalating to %s",
+		pluginName, policy.maxRestarts, policy.window, policy.escalation)
+	delete(s.supervised, pluginName)
+	if err == nil {
+		err = fmt.Errorf("plugin %s keeps returning from start", pluginName)
+	}
+	switch policy.escalation {
+	case EscalateStopService:
+		serr := s.Stop()
+		if serr != nil {
+			s.logger.Error("failed to stop service: %v", serr)
+		}
+		return true, errors.Wrapf(err, "plugin %s restarted too many times", pluginName)
+	default:
+		uerr := s.UnloadPlugin(pluginName)
+		if uerr != nil {
+			s.logger.Error("failed to unload failed plugin %s: %v", pluginName, uerr)
+		}
+		s.failPlugin(pluginName, err)
+	}
+	return false, nil
+}
+
+//handleRespawnMsg decide whether the crashed process of plugin is respawned,
+//it's asked by the plugin runner. A respawn is a restart of plugin, it's
+//counted in the same restart window, and escalated as the runner gives up.
+func (s *Service) handleRespawnMsg(msg MsgBase) {
+	pluginName := msg.From()
+	startID, _ := msg.GetRequest()["start_id"].(string)
+	pc, ok := s.pluginConfigs[pluginName]
+	if !ok || startID != s.startIDs[pluginName] {
+		// e.g. a new version being upgraded to, or plugin is restarted already
+		msg.SetError(NewError(ErrCodeNotFound, "start %s of plugin %s isn't supervised", startID, pluginName))
+		return
+	}
+	// jobs and scheduled runs aren't supervised
+	if s.isJob(pluginName) || s.isScheduled(pluginName) {
+		msg.SetError(NewError(ErrCodeRejected, "plugin %s runs as a job, it isn't supervised", pluginName))
+		return
+	}
+	policy, _ := pc.restartPolicy()
+	if policy.restart == RestartNever {
+		msg.SetError(NewError(ErrCodeRejected, "restart policy of plugin %s is %s", pluginName, policy.restart))
+		return
+	}
+	state := s.supervisorOf(pluginName, pc)
+	backoff, ok := state.allowRestart(policy)
+	if !ok {
+		msg.SetError(NewError(ErrCodeRejected, "plugin %s restarted %d times in %v", pluginName, policy.maxRestarts, policy.window))
+		return
+	}
+	s.logger.Info("respawn plugin %s %d/%d in %v",
+		pluginName, len(state.restarts), policy.maxRestarts, backoff)
+	msg.SetResponse(map[string]interface{}{
+		"backoff":  backoff.String(),
+		"restarts": len(state.restarts),
+	})
+}
+
+//handleRestartMsg restarts plugin, restart_id is set if it's scheduled by supervisor
+func (s *Service) handleRestartMsg(msg MsgBase) {
+	pluginName, _ := msg.GetRequest()["name"].(string)
+	restartID, _ := msg.GetRequest()["restart_id"].(string)
+	var pc PluginConfig
+	if restartID != "" {
+		state, ok := s.supervised[pluginName]
+		if !ok || state.restartID != restartID {
+			// plugin is unloaded or restarted by others
+			s.logger.Debug("skip outdated restart of plugin %s", pluginName)
+			return
+		}
+		state.restartID = ""
+		pc = state.config
+	} else {
+		config, ok := s.pluginConfigs[pluginName]
+		if !ok {
+			msg.SetError(NewError(ErrCodeNotFound, "plugin %s isn't loaded", pluginName))
+			return
+		}
+		pc = config
+	}
+	err := s.RestartPlugin(pc)
+	if err != nil {
+		s.logger.Error("failed to restart plugin %s: %v", pluginName, err)
+		if restartID != "" {
+			// counted as another exit
+			if stop, serr := s.pluginExited(pluginName, err); stop {
+				msg.SetError(serr)
+				return
+			}
+		}
+	}
+	msg.SetError(err)
+}
+
+//RestartPlugin stop plugin and start a new one with pc,
+//msgs queued for plugin are delivered to the new one
+func (s *Service) RestartPlugin(pc PluginConfig) error {
+	pluginName := pc.InstanceName()
+	s.logger.Info("Restarting plugin %s", pluginName)
+	if pl, ok := s.Plugins[pluginName]; ok {
+		s.mustSetState(pluginName, StateStopping, nil)
+		if cancel, ok := s.cancelFuncs[pluginName]; ok {
+			cancel()
+			delete(s.cancelFuncs, pluginName)
+		}
+		err := s.stopPlugin(pluginName, pl)
+		if err != nil {
+			s.logger.Error("failed to stop plugin %s for restart: %v", pluginName, err)
+			s.mustSetState(pluginName, StateFailed, err)
+		} else {
+			s.mustSetState(pluginName, StateStopped, nil)
+		}
+		delete(s.Plugins, pluginName)
+		s.RemoveInterceptor(pluginName)
+	}
+	_, err := s.LoadPlugin(pc)
+	if err != nil {
+		s.failPlugin(pluginName, err)
+		return errors.Wrapf(err, "failed to load plugin %s", pluginName)
+	}
+	err = s.InitPlugin(pc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to init plugin %s", pluginName)
+	}
+	err = s.StartPlugin(pluginName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to start plugin %s", pluginName)
+	}
+	s.logger.Info("Restarted plugin %s", pluginName)
+	return nil
+}
@@ -0,0 +1,121 @@
+package elsvc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+//testReturn makes Start of echo return with err
+func testReturn(svcChan chan interface{}, err error) {
+	msg := NewMsg("echo", "return")
+	msg.MsgFrom = "test"
+	msg.SetRequest(map[string]interface{}{"error": err})
+	svcChan <- msg
+}
+
+//testRestarted waits for echo to be running again, started after since
+func testRestarted(t *testing.T, svcChan chan interface{}, since time.Time) time.Time {
+	var startedAt time.Time
+	waitFor(t, 10*time.Second, "restart of echo", func() bool {
+		status := testStatus(t, svcChan, "echo")
+		startedAt, _ = status["started_at"].(time.Time)
+		return status["state"] == string(StateRunning) && startedAt.After(since)
+	})
+	return startedAt
+}
+
+func supervisorConfig(dir, policy string) string {
+	return fmt.Sprintf(`
+log_level: info
+plugin_mode: hcplugin
+plugins:
+  - type: echo
+    plugin_path: %s
+%s`, dir, policy)
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	boom := NewError(ErrCodeInternal, "boom")
+	tests := []struct {
+		name      string
+		policy    string
+		err       error
+		restarted bool
+	}{
+		{name: "never", policy: "    restart: never\n", err: boom},
+		{name: "on-failure with error", policy: "    restart: on-failure\n", err: boom, restarted: true},
+		{name: "on-failure without error", policy: "    restart: on-failure\n"},
+		{name: "always without error", policy: "    restart: always\n", restarted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testPluginDir(t, "echo.so")
+			defer os.RemoveAll(dir)
+			svcChan, _, stop := runService(t, supervisorConfig(dir, tt.policy))
+			defer stop()
+			startedAt, _ := testStatus(t, svcChan, "echo")["started_at"].(time.Time)
+
+			testReturn(svcChan, tt.err)
+			if tt.restarted {
+				testRestarted(t, svcChan, startedAt)
+				return
+			}
+			// unloaded instead, it stays failed or stopped
+			want := StateStopped
+			if tt.err != nil {
+				want = StateFailed
+			}
+			waitFor(t, 10*time.Second, "echo to be unloaded", func() bool {
+				return testState(t, svcChan, "echo") == want
+			})
+			time.Sleep(5 * minRestartBackoff)
+			if state := testState(t, svcChan, "echo"); state != want {
+				t.Errorf("echo is %s, want it to stay %s", state, want)
+			}
+		})
+	}
+}
+
+func TestSupervisorEscalate(t *testing.T) {
+	boom := NewError(ErrCodeInternal, "boom")
+	t.Run("fail plugin", func(t *testing.T) {
+		dir := testPluginDir(t, "echo.so")
+		defer os.RemoveAll(dir)
+		svcChan, _, stop := runService(t, supervisorConfig(dir, "    restart: always\n    max_restarts: 2\n"))
+		defer stop()
+		startedAt, _ := testStatus(t, svcChan, "echo")["started_at"].(time.Time)
+		for i := 0; i < 2; i++ {
+			testReturn(svcChan, boom)
+			startedAt = testRestarted(t, svcChan, startedAt)
+		}
+		// the third exit in restart window is escalated
+		testReturn(svcChan, boom)
+		waitFor(t, 10*time.Second, "echo to fail", func() bool {
+			return testState(t, svcChan, "echo") == StateFailed
+		})
+		time.Sleep(5 * minRestartBackoff)
+		if state := testState(t, svcChan, "echo"); state != StateFailed {
+			t.Errorf("echo is %s, want it to stay failed", state)
+		}
+	})
+	t.Run("stop service", func(t *testing.T) {
+		dir := testPluginDir(t, "echo.so")
+		defer os.RemoveAll(dir)
+		svcChan, exited, stop := runService(t, supervisorConfig(dir, "    restart: always\n    max_restarts: 1\n    escalation: stop_service\n"))
+		defer stop()
+		startedAt, _ := testStatus(t, svcChan, "echo")["started_at"].(time.Time)
+		testReturn(svcChan, boom)
+		testRestarted(t, svcChan, startedAt)
+		testReturn(svcChan, boom)
+		select {
+		case err := <-exited:
+			if err == nil || ErrorCode(err) != ErrCodeInternal {
+				t.Errorf("service stopped with %v, want the error of echo", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("service isn't stopped by escalation")
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package elsvc
+
+import (
+	"sort"
+	"strings"
+)
+
+//TopicPrefix marks msg target as a topic instead of a plugin
+const TopicPrefix = "topic:"
+
+//TopicPluginEvents is where lifecycle events of plugins are published
+const TopicPluginEvents = TopicPrefix + "plugin_events"
+
+func isTopic(msgTo string) bool {
+	return strings.HasPrefix(msgTo, TopicPrefix)
+}
+
+//handleTopicMsg handles subscribe and unsubscribe msgs,
+//subscriber is the sender of msg
+func (s *Service) handleTopicMsg(msg MsgBase) {
+	topic, _ := msg.GetRequest()["topic"].(string)
+	topic = Topic(topic)
+	if topic == TopicPrefix || msg.From() == "" {
+		msg.SetError(NewError(ErrCodeRejected, "invalid %s msg: topic=%q subscriber=%q", msg.Type(), topic, msg.From()))
+		return
+	}
+	switch msg.Type() {
+	case MsgSubscribe:
+		if _, ok := s.topics[topic]; !ok {
+			s.topics[topic] = make(map[string]bool)
+		}
+		s.topics[topic][msg.From()] = true
+		s.logger.Info("plugin %s subscribed %s", msg.From(), topic)
+	case MsgUnsubscribe:
+		delete(s.topics[topic], msg.From())
+		if len(s.topics[topic]) == 0 {
+			delete(s.topics, topic)
+		}
+		s.logger.Info("plugin %s unsubscribed %s", msg.From(), topic)
+	}
+	msg.SetError(nil)
+}
+
+//unsubscribeAll removes plugin from all topics
+func (s *Service) unsubscribeAll(pluginName string) {
+	for topic, subscribers := range s.topics {
+		delete(subscribers, pluginName)
+		if len(subscribers) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+}
+
+//publishMsg route a copy of msg to every subscriber of its topic.
+//Copies share the reply slot of msg, the first response wins.
+func (s *Service) publishMsg(msg MsgBase) {
+	subscribers := make([]string, 0, len(s.topics[msg.To()]))
+	for name := range s.topics[msg.To()] {
+		subscribers = append(subscribers, name)
+	}
+	if len(subscribers) == 0 {
+		// events of service are published whether anyone listens or not
+		if msg.From() == ChanKeyService {
+			s.logger.Debug("no subscriber for msg: %+v", msg)
+			return
+		}
+		s.rejectMsg(msg, NewError(ErrCodeNotFound, "msg %s to %s undeliverable: no subscriber", msg.Type(), msg.To()))
+		return
+	}
+	sort.Strings(subscribers)
+	for _, name := range subscribers {
+		cmsg := msg
+		cmsg.MsgId = newMsgID()
+		cmsg.inherit(msg)
+		cmsg.MsgTo = name
+		cmsg.MsgRequest = make(map[string]interface{}, len(msg.MsgRequest))
+		for k, v := range msg.MsgRequest {
+			cmsg.MsgRequest[k] = v
+		}
+		cmsg.Headers = nil
+		for k, v := range msg.Headers {
+			cmsg.SetHeader(k, v)
+		}
+		s.routeMsg(cmsg)
+	}
+}
@@ -0,0 +1,441 @@
+package elsvc
+
+import (
+	"context"
+	"time"
+)
+
+//upgrade is a blue/green upgrade of a running plugin. The new version is
+//started next to the running one with its own in-chan, and takes msgs of
+//plugin once it's ready. The old version is drained and stopped then.
+type upgrade struct {
+	id       string // start id of the new version
+	to       string // binary of the new version
+	pl       PluginLoaderIntf
+	inChan   chan interface{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer // fails upgrade if the new version isn't ready in time
+	promoted bool        // msgs are switched to the new version
+	// the new version is started or checked off routing loop, see
+	// MsgUpgradeStarted and MsgUpgradeChecked
+	starting bool
+	checking bool
+	// ready or exit of the new version came before MsgUpgradeStarted
+	ready   bool
+	exitErr error
+	// plugin is unloaded while the new version is starting
+	cancelErr error
+	// the old version, stopped after it's drained
+	old       PluginLoaderIntf
+	oldCancel context.CancelFunc
+	event     map[string]interface{} // published with MsgPluginUpgraded
+	req       *MsgBase               // MsgUpgradePlugin waiting for the result
+}
+
+//drainer is a plugin holding msgs it took from in-chan, e.g. in the queue of its process
+type drainer interface {
+	drain(ctx context.Context) error
+}
+
+//requestUpgrade begin upgrade of plugin named in msg to binary "path",
+//or the latest version matching its config if it's not set
+func (s *Service) requestUpgrade(msg *MsgBase) error {
+	if s.config.PluginMode != PluginModeHC || s.config.RunMode != RunModeSvc {
+		return NewError(ErrCodeRejected, "plugins could only be upgraded in %s mode with %s", RunModeSvc, PluginModeHC)
+	}
+	pluginName, _ := msg.GetRequest()["name"].(string)
+	pc, ok := s.pluginConfigs[pluginName]
+	if !ok {
+		return NewError(ErrCodeNotFound, "plugin %s not found", pluginName)
+	}
+	if pc.SHA256 != "" {
+		return NewError(ErrCodeRejected, "plugin %s is pinned by sha256 in config", pluginName)
+	}
+	pluginPath, _ := msg.GetRequest()["path"].(string)
+	if pluginPath != "" && !isFile(pluginPath) {
+		return NewError(ErrCodeNotFound, "plugin binary %s not found", pluginPath)
+	}
+	if pluginPath == "" {
+		var err error
+		pluginPath, err = pc.findSO()
+		if err != nil {
+			return err
+		}
+	}
+	return s.upgradePlugin(pluginName, pluginPath, msg)
+}
+
+//upgradePlugin start binary at pluginPath next to the running plugin in
+//background, msgs are switched to it once it's ready and healthy, see promote.
+//The running plugin is left as is if the new one fails to load, init, start or
+//get ready. Error is returned if upgrade can't begin, otherwise the result is
+//published with MsgPluginUpgraded, and sent to req if it's not nil.
+func (s *Service) upgradePlugin(pluginName, pluginPath string, req *MsgBase) error {
+	if _, ok := s.upgrades[pluginName]; ok {
+		return NewError(ErrCodeRejected, "plugin %s is being upgraded already", pluginName)
+	}
+	if s.isScheduled(pluginName) {
+		return NewError(ErrCodeRejected, "plugin %s is scheduled, its runs pick the latest version", pluginName)
+	}
+	state := s.pluginState(pluginName)
+	if state != StateRunning && state != StateStarting {
+		return NewError(ErrCodeRejected, "plugin %s is %s, only running plugins could be upgraded", pluginName, state)
+	}
+	st := s.states[pluginName]
+	u := &upgrade{
+		id:     newMsgID(),
+		to:     pluginPath,
+		inChan: make(chan interface{}),
+		req:    req,
+		event: map[string]interface{}{
+			"plugin":       pluginName,
+			"from":         st.path,
+			"from_version": st.version,
+			"to":           pluginPath,
+			"to_version":   soVersion(pluginPath),
+		},
+	}
+	s.upgrades[pluginName] = u
+	s.logger.Info("Upgrading plugin %s from %s to %s", pluginName, st.path, pluginPath)
+	pc := s.pluginConfigs[pluginName]
+	// load exactly the binary found
+	pc.PluginDir = pluginPath
+	u.pl = s.newLoader()
+	// the new version gets no msgs until it's promoted
+	u.ctx, u.cancel = s.pluginContextOn(pluginName, u.id, u.inChan)
+	u.starting = true
+	stopTimeout, _ := pc.stopTimeout()
+	msg := NewMsg(ChanKeyService, MsgUpgradeStarted)
+	msg.MsgFrom = ChanKeyService
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	go func() {
+		loaded, err := u.start(pc)
+		msg.SetRequest(map[string]interface{}{
+			"name":       pluginName,
+			"upgrade_id": u.id,
+			"loaded":     loaded,
+			"error":      err,
+		})
+		select {
+		case <-done:
+		default:
+			select {
+			case svcChan <- msg:
+				return
+			case <-done:
+			}
+		}
+		// service is stopped, nobody takes the new version
+		if loaded {
+			ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancel()
+			u.pl.Stop(ctx)
+		}
+	}()
+	return nil
+}
+
+//start load, init and start the new version off routing loop. It returns
+//true if the new version is loaded, it should be stopped then.
+func (s *upgrade) start(pc PluginConfig) (bool, error) {
+	pluginName := pc.InstanceName()
+	err := s.pl.Load(pc)
+	if err != nil {
+		return false, wrapError(err, "failed to load plugin %s", pluginName)
+	}
+	ctx := context.WithValue(context.Background(), CtxKeyConfig, pc.Config())
+	err = s.pl.Init(ctx)
+	if err != nil {
+		return true, wrapError(err, "failed to init plugin %s", pluginName)
+	}
+	err = s.pl.Start(s.ctx)
+	if err != nil {
+		return true, wrapError(err, "failed to start plugin %s from %s", pluginName, s.to)
+	}
+	return true, nil
+}
+
+//upgradeStarted go on with upgrade of plugin when its new version is started,
+//it's promoted once it's ready and healthy
+func (s *Service) upgradeStarted(pluginName string, loaded bool, err error) {
+	u := s.upgrades[pluginName]
+	u.starting = false
+	if !loaded {
+		u.pl = nil
+	}
+	// e.g. plugin is unloaded, or the new version exited meanwhile
+	if err == nil {
+		err = u.cancelErr
+	}
+	if err == nil {
+		err = u.exitErr
+	}
+	if err != nil {
+		s.abortUpgrade(pluginName, err)
+		return
+	}
+	pc := s.pluginConfigs[pluginName]
+	if u.ready || !pc.WaitReady {
+		s.checkVersion(pluginName)
+		return
+	}
+	// checked when it calls Ready
+	timeout, _ := parseTimeout("ready_timeout", pc.ReadyTimeout, defaultReadyTimeout)
+	msg := NewMsg(ChanKeyService, MsgUpgradeTimeout)
+	msg.MsgFrom = ChanKeyService
+	msg.SetRequest(map[string]interface{}{
+		"name":       pluginName,
+		"upgrade_id": u.id,
+		"timeout":    timeout.String(),
+	})
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	u.timer = time.AfterFunc(timeout, func() {
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	})
+}
+
+//checkVersion probe the new version of plugin once within its health_timeout
+//off routing loop, it's promoted if it's healthy, see MsgUpgradeChecked
+func (s *Service) checkVersion(pluginName string) {
+	u := s.upgrades[pluginName]
+	if u.checking {
+		return
+	}
+	hc, ok := u.pl.(HealthChecker)
+	if !ok {
+		s.promote(pluginName)
+		return
+	}
+	u.checking = true
+	conf, _ := s.pluginConfigs[pluginName].healthConfig()
+	msg := NewMsg(ChanKeyService, MsgUpgradeChecked)
+	msg.MsgFrom = ChanKeyService
+	ctx := u.ctx
+	upgradeID := u.id
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	go func() {
+		err := checkHealth(ctx, hc, conf.timeout)
+		msg.SetRequest(map[string]interface{}{
+			"name":       pluginName,
+			"upgrade_id": upgradeID,
+			"error":      err,
+		})
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	}()
+}
+
+//promote switch msgs of plugin to its new version checked healthy,
+//then drain the old version in background, see MsgUpgradeDrained
+func (s *Service) promote(pluginName string) {
+	u := s.upgrades[pluginName]
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	// e.g. the old version crashed meanwhile
+	state := s.pluginState(pluginName)
+	if state != StateRunning && state != StateStarting {
+		s.abortUpgrade(pluginName, NewError(ErrCodeUnavailable, "plugin %s is %s while upgrading", pluginName, state))
+		return
+	}
+	u.promoted = true
+	u.old = s.Plugins[pluginName]
+	u.oldCancel = s.cancelFuncs[pluginName]
+	// msgs queued from now on go to the new version, the ones
+	// taken by the old version already are left to it
+	s.mailboxes[pluginName].switchOut(u.inChan)
+	s.Chans[pluginName] = u.inChan
+	s.Plugins[pluginName] = u.pl
+	s.cancelFuncs[pluginName] = u.cancel
+	// exit of the old version is outdated from now on
+	s.startIDs[pluginName] = u.id
+	s.ready[pluginName] = true
+	st := s.states[pluginName]
+	st.path = u.to
+	st.version = soVersion(u.to)
+	st.meta = u.pl.Meta()
+	if state == StateStarting {
+		s.mustSetState(pluginName, StateRunning, nil)
+	}
+	s.startProbe(u.ctx, pluginName, u.pl)
+	s.logger.Info("Switched msgs of plugin %s to %s", pluginName, u.to)
+	d, ok := u.old.(drainer)
+	if !ok {
+		s.retire(pluginName, nil)
+		return
+	}
+	s.logger.Info("Draining plugin %s from %s", pluginName, u.event["from"])
+	timeout, _ := s.pluginConfigs[pluginName].stopTimeout()
+	msg := NewMsg(ChanKeyService, MsgUpgradeDrained)
+	msg.MsgFrom = ChanKeyService
+	upgradeID := u.id
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := d.drain(ctx)
+		msg.SetRequest(map[string]interface{}{
+			"name":       pluginName,
+			"upgrade_id": upgradeID,
+			"error":      err,
+		})
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	}()
+}
+
+//retire stop the old version of plugin after it's drained, and end the upgrade
+func (s *Service) retire(pluginName string, drainErr error) {
+	u := s.upgrades[pluginName]
+	if drainErr != nil {
+		s.logger.Error("failed to drain plugin %s from %s: %v", pluginName, u.event["from"], drainErr)
+		u.event["drain_error"] = AsMsgError(drainErr)
+	}
+	if u.oldCancel != nil {
+		u.oldCancel()
+	}
+	if u.old != nil {
+		err := s.stopPlugin(pluginName, u.old)
+		if err != nil {
+			s.logger.Error("failed to stop plugin %s from %s: %v", pluginName, u.event["from"], err)
+			u.event["stop_error"] = AsMsgError(err)
+		}
+	}
+	s.logger.Info("Upgraded plugin %s to %s", pluginName, u.to)
+	s.endUpgrade(pluginName, nil)
+}
+
+//abortUpgrade stop the new version of plugin, the old one keeps running
+func (s *Service) abortUpgrade(pluginName string, err error) {
+	u := s.upgrades[pluginName]
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	if u.cancel != nil {
+		u.cancel()
+	}
+	if u.pl != nil {
+		stopErr := s.stopPlugin(pluginName, u.pl)
+		if stopErr != nil {
+			s.logger.Error("failed to stop plugin %s from %s: %v", pluginName, u.to, stopErr)
+		}
+	}
+	s.logger.Error("failed to upgrade plugin %s to %s, keep running %s: %v", pluginName, u.to, u.event["from"], err)
+	u.event["rolled_back"] = true
+	s.endUpgrade(pluginName, err)
+}
+
+//endUpgrade publish the result of upgrade of plugin, and reply it to the request
+func (s *Service) endUpgrade(pluginName string, err error) {
+	u := s.upgrades[pluginName]
+	delete(s.upgrades, pluginName)
+	if err != nil {
+		u.event["error"] = AsMsgError(err)
+		// it's not tried again by watch
+		if w, ok := s.watches[pluginName]; ok {
+			w.failed = u.to
+		}
+	}
+	s.publishEvent(MsgPluginUpgraded, u.event)
+	if u.req != nil {
+		u.req.SetResponse(u.event)
+	}
+}
+
+//cancelUpgrade end upgrade of plugin being unloaded, the new version is
+//stopped if it's not promoted yet, or the old one if it's being drained
+func (s *Service) cancelUpgrade(pluginName string) {
+	u, ok := s.upgrades[pluginName]
+	if !ok {
+		return
+	}
+	if u.promoted {
+		s.retire(pluginName, NewError(ErrCodeUnavailable, "plugin %s is unloaded", pluginName))
+		return
+	}
+	if u.starting {
+		// ended when MsgUpgradeStarted comes
+		u.cancel()
+		u.cancelErr = NewError(ErrCodeUnavailable, "plugin %s is unloaded while upgrading", pluginName)
+		return
+	}
+	s.abortUpgrade(pluginName, NewError(ErrCodeUnavailable, "plugin %s is unloaded while upgrading", pluginName))
+}
+
+//upgradeReady promote the new version of plugin if it's the one started with startID,
+//it returns false if it's not
+func (s *Service) upgradeReady(pluginName, startID string) bool {
+	u, ok := s.upgrades[pluginName]
+	if !ok || u.promoted || u.id != startID {
+		return false
+	}
+	s.logger.Info("plugin %s from %s is ready", pluginName, u.to)
+	if u.starting {
+		u.ready = true
+		return true
+	}
+	s.checkVersion(pluginName)
+	return true
+}
+
+//upgradeExited fails upgrade if the new version of plugin started with startID
+//returns from start before it's promoted, it returns false if it's not the one
+func (s *Service) upgradeExited(pluginName, startID string, err error) bool {
+	u, ok := s.upgrades[pluginName]
+	if !ok || u.promoted || u.id != startID {
+		return false
+	}
+	if err == nil {
+		err = NewError(ErrCodeUnavailable, "plugin %s from %s returned from start before ready", pluginName, u.to)
+	} else {
+		err = wrapError(err, "plugin %s from %s returned from start before ready", pluginName, u.to)
+	}
+	if u.starting {
+		u.exitErr = err
+		return true
+	}
+	s.abortUpgrade(pluginName, err)
+	return true
+}
+
+//handleUpgradeMsg handle timers and results of upgrades done off routing loop
+func (s *Service) handleUpgradeMsg(msg MsgBase) {
+	pluginName, _ := msg.GetRequest()["name"].(string)
+	upgradeID, _ := msg.GetRequest()["upgrade_id"].(string)
+	u, ok := s.upgrades[pluginName]
+	if !ok || u.id != upgradeID {
+		// upgrade ended already
+		return
+	}
+	switch msg.Type() {
+	case MsgUpgradeStarted:
+		loaded, _ := msg.GetRequest()["loaded"].(bool)
+		s.upgradeStarted(pluginName, loaded, msg.GetRequestError())
+	case MsgUpgradeChecked:
+		u.checking = false
+		if err := msg.GetRequestError(); err != nil {
+			s.abortUpgrade(pluginName, wrapError(err, "plugin %s from %s isn't healthy", pluginName, u.to))
+			return
+		}
+		s.promote(pluginName)
+	case MsgUpgradeTimeout:
+		if !u.promoted {
+			timeout, _ := msg.GetRequest()["timeout"].(string)
+			s.abortUpgrade(pluginName, NewError(ErrCodeTimeout, "plugin %s from %s isn't ready in %s", pluginName, u.to, timeout))
+		}
+	case MsgUpgradeDrained:
+		s.retire(pluginName, msg.GetRequestError())
+	}
+}
@@ -0,0 +1,119 @@
+package elsvc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testPong returns pid and version of the plugin process replying ping
+func testPong(t *testing.T, svcChan chan interface{}) (int, string) {
+	resp, err := testRequest(svcChan, NewMsg("echo", "ping"))
+	if err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	pid, _ := resp["pid"].(float64)
+	version, _ := resp["version"].(string)
+	return int(pid), version
+}
+
+//testUpgrade upgrade echo to binary at path, and returns the upgrade event
+func testUpgrade(svcChan chan interface{}, path string) (map[string]interface{}, error) {
+	msg := NewMsg(ChanKeyService, MsgUpgradePlugin)
+	msg.SetRequest(map[string]interface{}{"name": "echo", "path": path})
+	return testRequest(svcChan, msg)
+}
+
+func upgradeConfig(dir string) string {
+	return fmt.Sprintf(`
+log_level: info
+plugin_mode: hcplugin
+plugins:
+  - type: echo
+    plugin_path: %s
+`, dir)
+}
+
+func TestUpgradePlugin(t *testing.T) {
+	dir := testPluginDir(t, "echo.so.1.0.0")
+	defer os.RemoveAll(dir)
+	svcChan, _, stop := runService(t, upgradeConfig(dir))
+	defer stop()
+	pid, version := testPong(t, svcChan)
+	if version != "1.0.0" {
+		t.Fatalf("echo is %s, want 1.0.0", version)
+	}
+
+	// routing goes on while the new version inits
+	linkTestPlugin(t, dir, "echo.so.1.1.0-slow")
+	result := make(chan error, 1)
+	var event map[string]interface{}
+	go func() {
+		var err error
+		event, err = testUpgrade(svcChan, filepath.Join(dir, "echo.so.1.1.0-slow"))
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	begin := time.Now()
+	if _, version := testPong(t, svcChan); version != "1.0.0" {
+		t.Errorf("echo is %s while upgrading, want 1.0.0", version)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("ping took %v while upgrading", d)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	if event["to_version"] != "1.1.0-slow" {
+		t.Errorf("upgraded to %v, want 1.1.0-slow", event["to_version"])
+	}
+	upgraded, version := testPong(t, svcChan)
+	if version != "1.1.0-slow" || upgraded == pid {
+		t.Errorf("ping is replied by %s process %d, want 1.1.0-slow in a new process", version, upgraded)
+	}
+}
+
+func TestUpgradeRollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		binary string
+	}{
+		{name: "init fails", binary: "echo.so.1.1.0-broken"},
+		{name: "unhealthy", binary: "echo.so.1.1.0-unhealthy"},
+		{name: "load fails", binary: "echo.so.1.1.0-missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testPluginDir(t, "echo.so.1.0.0")
+			defer os.RemoveAll(dir)
+			svcChan, _, stop := runService(t, upgradeConfig(dir))
+			defer stop()
+			pid, _ := testPong(t, svcChan)
+			path := filepath.Join(dir, tt.binary)
+			if tt.name != "load fails" {
+				linkTestPlugin(t, dir, tt.binary)
+			} else if err := ioutil.WriteFile(path, []byte("not a plugin"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			event, err := testUpgrade(svcChan, path)
+			if err == nil {
+				t.Fatalf("upgrade to %s should fail", tt.binary)
+			}
+			if rolledBack, _ := event["rolled_back"].(bool); !rolledBack {
+				t.Errorf("upgrade event %+v isn't rolled back", event)
+			}
+			// the old version keeps serving
+			current, version := testPong(t, svcChan)
+			if version != "1.0.0" || current != pid {
+				t.Errorf("ping is replied by %s process %d, want 1.0.0 process %d", version, current, pid)
+			}
+			if state := testState(t, svcChan, "echo"); state != StateRunning {
+				t.Errorf("echo is %s after rollback, want %s", state, StateRunning)
+			}
+		})
+	}
+}
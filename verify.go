@@ -0,0 +1,221 @@
+package elsvc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//Sidecar files next to plugin binary
+const (
+	checksumExt  = ".sha256" // hex sha256 of binary, e.g. output of sha256sum
+	signatureExt = ".sig"    // ed25519 signature of binary, raw or base64
+)
+
+//verifier checks plugin binaries before they're opened or run
+type verifier struct {
+	requireChecksum bool
+	keys            []ed25519.PublicKey // binaries must be signed by one of them if it's not empty
+	// copies of verified binaries, see private
+	dir string
+	mut sync.Mutex
+}
+
+//verifier returns the validated verification config of service
+func (s ServiceConfig) verifier() (*verifier, error) {
+	v := &verifier{requireChecksum: s.VerifyPlugins}
+	for _, k := range s.TrustedKeys {
+		key, err := decodeKey(k, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key %s: %v", k, err)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(key))
+	}
+	return v, nil
+}
+
+//decodeKey decode hex or base64 of size bytes
+func decodeKey(s string, size int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == size*2 {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("neither hex nor base64")
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("%d bytes, should be %d", len(b), size)
+	}
+	return b, nil
+}
+
+//checksum returns the validated sha256 of plugin binary in config
+func (s PluginConfig) checksum() ([]byte, error) {
+	if s.SHA256 == "" {
+		return nil, nil
+	}
+	return decodeKey(s.SHA256, sha256.Size)
+}
+
+//isSidecar reports whether file is a sidecar of plugin binary, not a binary
+func isSidecar(name string) bool {
+	return strings.HasSuffix(name, checksumExt) || strings.HasSuffix(name, signatureExt)
+}
+
+//verify check binaryPath of plugin against sha256 in config or its sidecar,
+//and its signature if there are trusted keys. It returns the path to open or
+//run, a private copy of the bytes verified, so binaryPath replaced meanwhile
+//isn't run unchecked. It's binaryPath itself if there's nothing to check.
+func (s *verifier) verify(pc PluginConfig, binaryPath string) (string, error) {
+	if s == nil {
+		s = &verifier{}
+	}
+	data, err := ioutil.ReadFile(binaryPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	want, source, err := expectedChecksum(pc, binaryPath)
+	if err != nil {
+		return "", verifyError(pc, binaryPath, "%v", err)
+	}
+	if want == nil && s.requireChecksum {
+		return "", verifyError(pc, binaryPath, "no sha256 in config or %s", binaryPath+checksumExt)
+	}
+	if want != nil && !bytes.Equal(want, sum[:]) {
+		return "", verifyError(pc, binaryPath, "sha256 is %x, %s says %x", sum, source, want)
+	}
+	if want == nil && len(s.keys) == 0 {
+		return binaryPath, nil
+	}
+	if len(s.keys) != 0 {
+		sig, err := readSignature(binaryPath + signatureExt)
+		if err != nil {
+			return "", verifyError(pc, binaryPath, "%v", err)
+		}
+		signed := false
+		for _, key := range s.keys {
+			if ed25519.Verify(key, data, sig) {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return "", verifyError(pc, binaryPath, "signature isn't made by any trusted key")
+		}
+	}
+	return s.private(binaryPath, sum[:], data)
+}
+
+//private returns path of a copy of data verified for binaryPath, in a dir only
+//service could write. Copies are named by sha256, a goplugin opened again is
+//the same file.
+func (s *verifier) private(binaryPath string, sum []byte, data []byte) (string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.dir == "" {
+		dir, err := ioutil.TempDir("", "elsvc-verified")
+		if err != nil {
+			return "", err
+		}
+		s.dir = dir
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%x-%s", sum, filepath.Base(binaryPath)))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	f, err := ioutil.TempFile(s.dir, "copy")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+//cleanup remove copies of verified binaries, call it after plugins are stopped
+func (s *verifier) cleanup() {
+	if s == nil {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+		s.dir = ""
+	}
+}
+
+//expectedChecksum returns sha256 of binary in config, or in its sidecar, and where it's from
+func expectedChecksum(pc PluginConfig, binaryPath string) ([]byte, string, error) {
+	sum, err := pc.checksum()
+	if err != nil || sum != nil {
+		return sum, "config", err
+	}
+	sidecar := binaryPath + checksumExt
+	data, err := ioutil.ReadFile(sidecar)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("%s is empty", sidecar)
+	}
+	sum, err = decodeKey(fields[0], sha256.Size)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid sha256 in %s: %v", sidecar, err)
+	}
+	return sum, sidecar, nil
+}
+
+//readSignature read detached signature of binary, raw or base64
+func readSignature(sigPath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(sigPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("signature %s not found", sigPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := decodeKey(string(data), ed25519.SignatureSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature %s: %v", sigPath, err)
+	}
+	return sig, nil
+}
+
+func verifyError(pc PluginConfig, binaryPath string, format string, args ...interface{}) error {
+	reason := fmt.Sprintf(format, args...)
+	return NewError(ErrCodeRejected, "plugin %s failed verification of %s: %s", pc.InstanceName(), binaryPath, reason).
+		WithDetail("binary", binaryPath).
+		WithDetail("reason", reason)
+}
@@ -0,0 +1,178 @@
+package elsvc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		s       string
+		want    []byte
+		wantErr bool
+	}{
+		{s: hex.EncodeToString(raw), want: raw},
+		{s: "  " + hex.EncodeToString(raw) + "\n", want: raw},
+		{s: base64.StdEncoding.EncodeToString(raw), want: raw},
+		{s: hex.EncodeToString(raw[:31]), wantErr: true},
+		{s: base64.StdEncoding.EncodeToString(raw[:31]), wantErr: true},
+		{s: "not a key!", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeKey(tt.s, 32)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("decodeKey(%q) should fail", tt.s)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("decodeKey(%q) = %x, %v, want %x", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestServiceConfigVerifier(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServiceConfig{VerifyPlugins: true, TrustedKeys: []string{
+		hex.EncodeToString(pub), base64.StdEncoding.EncodeToString(pub),
+	}}
+	v, err := conf.verifier()
+	if err != nil {
+		t.Fatalf("verifier failed: %v", err)
+	}
+	if !v.requireChecksum || len(v.keys) != 2 {
+		t.Errorf("verifier = %+v, want checksum required and 2 keys", v)
+	}
+	conf.TrustedKeys = []string{"garbage"}
+	if _, err := conf.verifier(); err == nil {
+		t.Error("verifier with invalid trusted key should fail")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("plugin binary")
+	sum := sha256.Sum256(binary)
+	goodSum := hex.EncodeToString(sum[:])
+	badSum := hex.EncodeToString(make([]byte, sha256.Size))
+	sig := ed25519.Sign(priv, binary)
+	tests := []struct {
+		name     string
+		verifier *verifier
+		sha256   string // in config
+		sidecar  string // content of .sha256, none if empty
+		sig      []byte // content of .sig, none if nil
+		wantErr  bool
+	}{
+		{name: "nil verifier"},
+		{name: "nothing required", verifier: &verifier{}},
+		{name: "checksum required", verifier: &verifier{requireChecksum: true}, wantErr: true},
+		{name: "config checksum", verifier: &verifier{requireChecksum: true}, sha256: goodSum},
+		{name: "config base64 checksum", verifier: &verifier{requireChecksum: true},
+			sha256: base64.StdEncoding.EncodeToString(sum[:])},
+		{name: "config checksum mismatch", verifier: &verifier{}, sha256: badSum, wantErr: true},
+		{name: "invalid config checksum", verifier: &verifier{}, sha256: "xyz", wantErr: true},
+		{name: "sidecar checksum", verifier: &verifier{requireChecksum: true}, sidecar: goodSum + "  echo.so\n"},
+		{name: "sidecar checksum mismatch", verifier: &verifier{}, sidecar: badSum, wantErr: true},
+		{name: "empty sidecar", verifier: &verifier{}, sidecar: "\n", wantErr: true},
+		{name: "invalid sidecar", verifier: &verifier{}, sidecar: "xyz echo.so", wantErr: true},
+		{name: "config wins over sidecar", verifier: &verifier{}, sha256: goodSum, sidecar: badSum},
+		{name: "raw signature", verifier: &verifier{keys: []ed25519.PublicKey{pub}}, sig: sig},
+		{name: "base64 signature", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sig: []byte(base64.StdEncoding.EncodeToString(sig) + "\n")},
+		{name: "hex signature", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sig: []byte(hex.EncodeToString(sig))},
+		{name: "any trusted key", verifier: &verifier{keys: []ed25519.PublicKey{otherPub, pub}}, sig: sig},
+		{name: "missing signature", verifier: &verifier{keys: []ed25519.PublicKey{pub}}, wantErr: true},
+		{name: "bad signature", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sig: []byte("not a signature"), wantErr: true},
+		{name: "untrusted key", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sig: ed25519.Sign(otherPriv, binary), wantErr: true},
+		{name: "signature of other binary", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sig: ed25519.Sign(priv, []byte("other binary")), wantErr: true},
+		{name: "checksum and signature", verifier: &verifier{requireChecksum: true, keys: []ed25519.PublicKey{pub}},
+			sidecar: goodSum, sig: sig},
+		{name: "signed but checksum mismatch", verifier: &verifier{keys: []ed25519.PublicKey{pub}},
+			sha256: badSum, sig: sig, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "elsvc-verify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			binaryPath := filepath.Join(dir, "echo.so")
+			if err := ioutil.WriteFile(binaryPath, binary, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.sidecar != "" {
+				if err := ioutil.WriteFile(binaryPath+checksumExt, []byte(tt.sidecar), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.sig != nil {
+				if err := ioutil.WriteFile(binaryPath+signatureExt, tt.sig, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pc := PluginConfig{Type: "echo", SHA256: tt.sha256}
+			execPath, err := tt.verifier.verify(pc, binaryPath)
+			defer tt.verifier.cleanup()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("verify should fail")
+				}
+				if merr := AsMsgError(err); merr == nil || merr.Code != ErrCodeRejected {
+					t.Errorf("verify error = %v, want code %d", err, ErrCodeRejected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			// binary checked is run from a private copy
+			checked := tt.sha256 != "" || tt.sidecar != "" || (tt.verifier != nil && len(tt.verifier.keys) != 0)
+			if checked == (execPath == binaryPath) {
+				t.Errorf("verify returned %s for %s", execPath, binaryPath)
+			}
+			if err := ioutil.WriteFile(binaryPath, []byte("replaced"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(execPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checked && string(data) != string(binary) {
+				t.Errorf("%s has %q after binary is replaced, want the binary verified", execPath, data)
+			}
+		})
+	}
+}
+
+func TestVerifyMissingBinary(t *testing.T) {
+	v := &verifier{}
+	if _, err := v.verify(PluginConfig{Type: "echo"}, filepath.Join(os.TempDir(), "elsvc-missing.so")); err == nil {
+		t.Error("verify of missing binary should fail")
+	}
+}
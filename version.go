@@ -0,0 +1,266 @@
+package elsvc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//VersionLatest picks the highest version of plugin, pre-releases excluded
+const VersionLatest = "latest"
+
+//semver is a version of plugin binary named <plugin>.so.<version>,
+//e.g. 2, 1.4, 1.2.3 or 1.2.3-rc.1, missing parts are 0
+type semver struct {
+	major, minor, patch int
+	parts               int      // number of parts given, for partial versions in constraints
+	pre                 []string // pre-release identifiers
+}
+
+func parseSemver(version string) (*semver, error) {
+	v := strings.TrimPrefix(version, "v")
+	// build metadata doesn't count in precedence
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	s := &semver{}
+	if i := strings.Index(v, "-"); i >= 0 {
+		s.pre = strings.Split(v[i+1:], ".")
+		for _, id := range s.pre {
+			if id == "" {
+				return nil, fmt.Errorf("invalid pre-release in version %s", version)
+			}
+		}
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("version %s has more than 3 parts", version)
+	}
+	nums := []*int{&s.major, &s.minor, &s.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %s", version)
+		}
+		*nums[i] = n
+	}
+	s.parts = len(parts)
+	return s, nil
+}
+
+func (s *semver) String() string {
+	v := fmt.Sprintf("%d.%d.%d", s.major, s.minor, s.patch)
+	if len(s.pre) != 0 {
+		v += "-" + strings.Join(s.pre, ".")
+	}
+	return v
+}
+
+//compare returns -1, 0 or 1 if s is lower than, equal to or higher than o,
+//a pre-release is lower than its release
+func (s *semver) compare(o *semver) int {
+	for _, d := range []int{s.major - o.major, s.minor - o.minor, s.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(s.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(s.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(s.pre) && i < len(o.pre); i++ {
+		if d := comparePre(s.pre[i], o.pre[i]); d != 0 {
+			return d
+		}
+	}
+	return sign(len(s.pre) - len(o.pre))
+}
+
+//comparePre compare pre-release identifiers, numeric ones are lower than the others
+func comparePre(a, b string) int {
+	na, aerr := strconv.Atoi(a)
+	nb, berr := strconv.Atoi(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return sign(na - nb)
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+//sameCore reports whether s and o are the same major.minor.patch
+func (s *semver) sameCore(o *semver) bool {
+	return s.major == o.major && s.minor == o.minor && s.patch == o.patch
+}
+
+//versionBound is a comparison a version must pass, e.g. >=1.4.0
+type versionBound struct {
+	op string
+	v  *semver
+}
+
+func (s versionBound) match(v *semver) bool {
+	d := v.compare(s.v)
+	switch s.op {
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	}
+	return d == 0
+}
+
+//versionConstraint is the version config of plugin, e.g. ~1.4, ^2, =2.0.1,
+//>=1.2 <2 or latest. A version must pass all of its bounds, pre-releases
+//only match if the constraint names a pre-release of the same major.minor.patch.
+type versionConstraint struct {
+	expr   string
+	bounds []versionBound
+	pres   []*semver // pre-releases named in constraint
+}
+
+func parseConstraint(expr string) (*versionConstraint, error) {
+	c := &versionConstraint{expr: strings.TrimSpace(expr)}
+	if c.expr == "" || c.expr == VersionLatest || c.expr == "*" {
+		return c, nil
+	}
+	terms := strings.FieldsFunc(c.expr, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, term := range terms {
+		op := "="
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+			if strings.HasPrefix(term, prefix) {
+				op = prefix
+				break
+			}
+		}
+		v, err := parseSemver(strings.TrimPrefix(term, op))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %s: %v", expr, err)
+		}
+		if len(v.pre) != 0 {
+			c.pres = append(c.pres, v)
+		}
+		c.bounds = append(c.bounds, expandBounds(op, v)...)
+	}
+	return c, nil
+}
+
+//expandBounds returns bounds of a term, partial versions match all versions
+//they're a prefix of, e.g. =1.4 is >=1.4.0 <1.5.0
+func expandBounds(op string, v *semver) []versionBound {
+	if op != "=" && op != "~" && op != "^" {
+		return []versionBound{{op: op, v: v}}
+	}
+	if op == "=" && v.parts == 3 {
+		return []versionBound{{op: "=", v: v}}
+	}
+	upper := &semver{}
+	switch {
+	case op == "^" && v.major > 0, v.parts == 1:
+		upper.major = v.major + 1
+	case op == "^" && v.minor == 0 && v.parts == 3:
+		// ^0.0.3 is only 0.0.3
+		upper.minor = v.minor
+		upper.patch = v.patch + 1
+	default:
+		upper.major = v.major
+		upper.minor = v.minor + 1
+	}
+	// pre-releases of the upper bound are excluded too
+	upper.pre = []string{"0"}
+	return []versionBound{{op: ">=", v: v}, {op: "<", v: upper}}
+}
+
+//match reports whether v passes constraint, or why it doesn't
+func (s *versionConstraint) match(v *semver) (bool, string) {
+	if len(v.pre) != 0 && !s.allowPre(v) {
+		return false, fmt.Sprintf("%s is a pre-release", v)
+	}
+	for _, b := range s.bounds {
+		if !b.match(v) {
+			return false, fmt.Sprintf("%s doesn't match %s", v, s.expr)
+		}
+	}
+	return true, ""
+}
+
+func (s *versionConstraint) allowPre(v *semver) bool {
+	for _, pre := range s.pres {
+		if pre.sameCore(v) {
+			return true
+		}
+	}
+	return false
+}
+
+//pinned reports whether constraint restricts versions
+func (s *versionConstraint) pinned() bool {
+	return len(s.bounds) != 0
+}
+
+//findSO returns binary of plugin in plugin_path matching its version,
+//the error lists the candidates rejected if there's none
+func (s PluginConfig) findSO() (string, error) {
+	constraint, err := parseConstraint(s.Version)
+	if err != nil {
+		return "", err
+	}
+	pluginPath, rejected := findLatestSO(s.Type, s.PluginPath(), constraint)
+	for _, c := range rejected {
+		logger.Info("skip %s for plugin %s: %s", c.File, s.InstanceName(), c.Rejected)
+	}
+	if pluginPath != "" {
+		return pluginPath, nil
+	}
+	msg := fmt.Sprintf("failed to find plugin %s in %s", s.Type, s.PluginPath())
+	if constraint.pinned() {
+		msg = fmt.Sprintf("failed to find plugin %s of version %s in %s", s.Type, s.Version, s.PluginPath())
+	}
+	if len(rejected) == 0 {
+		return "", NewError(ErrCodeNotFound, "%s", msg)
+	}
+	reasons := make([]string, 0, len(rejected))
+	for _, c := range rejected {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", c.File, c.Rejected))
+	}
+	return "", NewError(ErrCodeNotFound, "%s, rejected %s", msg, strings.Join(reasons, "; ")).
+		WithDetail("rejected", rejected)
+}
+
+//newerVersion reports whether version of <plugin>.so.<version> is newer than current,
+//a binary without version is older than all versioned ones
+func newerVersion(version, current string) bool {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false
+	}
+	if current == "" {
+		return true
+	}
+	c, err := parseSemver(current)
+	return err != nil || v.compare(c) > 0
+}
@@ -0,0 +1,210 @@
+package elsvc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		parts   int
+		wantErr bool
+	}{
+		{version: "1.2.3", want: "1.2.3", parts: 3},
+		{version: "v1.2.3", want: "1.2.3", parts: 3},
+		{version: "2", want: "2.0.0", parts: 1},
+		{version: "1.4", want: "1.4.0", parts: 2},
+		{version: "1.2.3-rc.1", want: "1.2.3-rc.1", parts: 3},
+		{version: "1.2.3+build.7", want: "1.2.3", parts: 3},
+		{version: "1.2.3-beta+build", want: "1.2.3-beta", parts: 3},
+		{version: "", wantErr: true},
+		{version: "1.2.3.4", wantErr: true},
+		{version: "1.x", wantErr: true},
+		{version: "-1.2.3", wantErr: true},
+		{version: "1.-2", wantErr: true},
+		{version: "1.2.3-", wantErr: true},
+		{version: "1.2.3-rc..1", wantErr: true},
+	}
+	for _, tt := range tests {
+		v, err := parseSemver(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSemver(%q) = %s, want error", tt.version, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSemver(%q) failed: %v", tt.version, err)
+			continue
+		}
+		if v.String() != tt.want || v.parts != tt.parts {
+			t.Errorf("parseSemver(%q) = %s with %d parts, want %s with %d parts",
+				tt.version, v, v.parts, tt.want, tt.parts)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.2.3", b: "1.2.3", want: 0},
+		{a: "1.2.3", b: "1.2.4", want: -1},
+		{a: "1.3.0", b: "1.2.9", want: 1},
+		{a: "2.0.0", b: "1.99.99", want: 1},
+		{a: "1.4", b: "1.4.0", want: 0},
+		{a: "1.0.0-rc.1", b: "1.0.0", want: -1},
+		{a: "1.0.0", b: "1.0.0-rc.1", want: 1},
+		{a: "1.0.0-alpha", b: "1.0.0-alpha.1", want: -1},
+		{a: "1.0.0-alpha.1", b: "1.0.0-alpha.beta", want: -1},
+		{a: "1.0.0-beta.2", b: "1.0.0-beta.11", want: -1},
+		{a: "1.0.0-rc.1", b: "1.0.0-beta.11", want: 1},
+		{a: "1.0.0+a", b: "1.0.0+b", want: 0},
+	}
+	for _, tt := range tests {
+		a, err := parseSemver(tt.a)
+		if err != nil {
+			t.Fatalf("parseSemver(%q) failed: %v", tt.a, err)
+		}
+		b, err := parseSemver(tt.b)
+		if err != nil {
+			t.Fatalf("parseSemver(%q) failed: %v", tt.b, err)
+		}
+		if got := a.compare(b); got != tt.want {
+			t.Errorf("compare(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		expr     string
+		match    []string
+		mismatch []string
+	}{
+		{expr: "", match: []string{"0.0.1", "1.2.3", "99.0.0"}, mismatch: []string{"1.0.0-rc.1"}},
+		{expr: "latest", match: []string{"1.2.3"}, mismatch: []string{"2.0.0-beta"}},
+		{expr: "*", match: []string{"1.2.3"}, mismatch: []string{"2.0.0-beta"}},
+		{expr: "1.2.3", match: []string{"1.2.3", "1.2.3+build"}, mismatch: []string{"1.2.4", "1.2.2", "1.2.3-rc.1"}},
+		{expr: "=1.4", match: []string{"1.4.0", "1.4.9"}, mismatch: []string{"1.5.0", "1.3.9", "1.4.1-rc.1"}},
+		{expr: "2", match: []string{"2.0.0", "2.9.9"}, mismatch: []string{"1.9.9", "3.0.0", "3.0.0-rc.1"}},
+		{expr: "~1.4", match: []string{"1.4.0", "1.4.7"}, mismatch: []string{"1.5.0", "1.3.9"}},
+		{expr: "~1.4.2", match: []string{"1.4.2", "1.4.9"}, mismatch: []string{"1.4.1", "1.5.0"}},
+		{expr: "~1", match: []string{"1.0.0", "1.9.0"}, mismatch: []string{"2.0.0", "0.9.0"}},
+		{expr: "^1.2", match: []string{"1.2.0", "1.9.9"}, mismatch: []string{"1.1.9", "2.0.0", "2.0.0-rc.1"}},
+		{expr: "^0.2", match: []string{"0.2.0", "0.2.5"}, mismatch: []string{"0.3.0", "0.1.9"}},
+		{expr: "^0.2.3", match: []string{"0.2.3", "0.2.9"}, mismatch: []string{"0.2.2", "0.3.0"}},
+		{expr: "^0.0.3", match: []string{"0.0.3"}, mismatch: []string{"0.0.4", "0.0.2", "0.1.0"}},
+		{expr: "^0", match: []string{"0.0.1", "0.9.9"}, mismatch: []string{"1.0.0"}},
+		{expr: ">=1.2 <2", match: []string{"1.2.0", "1.9.9"}, mismatch: []string{"1.1.9", "2.0.0", "1.5.0-rc.1"}},
+		{expr: ">=1.2,<2", match: []string{"1.2.0", "1.9.9"}, mismatch: []string{"1.1.9", "2.0.0"}},
+		{expr: ">1.2.3", match: []string{"1.2.4"}, mismatch: []string{"1.2.3"}},
+		{expr: "<=1.2.3", match: []string{"1.2.3", "0.1.0"}, mismatch: []string{"1.2.4"}},
+		{expr: ">=1.5.0-rc.1", match: []string{"1.5.0-rc.1", "1.5.0-rc.2", "1.5.0", "2.0.0"},
+			mismatch: []string{"1.5.0-beta", "1.6.0-rc.1"}},
+		{expr: "=2.0.0-rc.1", match: []string{"2.0.0-rc.1"}, mismatch: []string{"2.0.0-rc.2", "2.0.0"}},
+	}
+	for _, tt := range tests {
+		c, err := parseConstraint(tt.expr)
+		if err != nil {
+			t.Errorf("parseConstraint(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		for _, version := range tt.match {
+			v, err := parseSemver(version)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) failed: %v", version, err)
+			}
+			if ok, reason := c.match(v); !ok {
+				t.Errorf("%q should match %s: %s", tt.expr, version, reason)
+			}
+		}
+		for _, version := range tt.mismatch {
+			v, err := parseSemver(version)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) failed: %v", version, err)
+			}
+			if ok, _ := c.match(v); ok {
+				t.Errorf("%q shouldn't match %s", tt.expr, version)
+			}
+		}
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, expr := range []string{"x", "~", ">=1.2 <y", "^1.2.3.4", "=1.2-"} {
+		if _, err := parseConstraint(expr); err == nil {
+			t.Errorf("parseConstraint(%q) should fail", expr)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		version, current string
+		want             bool
+	}{
+		{version: "1.2.0", current: "", want: true},
+		{version: "1.2.0", current: "1.1.9", want: true},
+		{version: "1.2.0", current: "1.2.0", want: false},
+		{version: "1.2.0", current: "1.3.0", want: false},
+		{version: "1.2.0", current: "garbage", want: true},
+		{version: "garbage", current: "1.2.0", want: false},
+	}
+	for _, tt := range tests {
+		if got := newerVersion(tt.version, tt.current); got != tt.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tt.version, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestFindLatestSO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elsvc-so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"echo.so", "echo.so.1.2.0", "echo.so.1.4.1", "echo.so.2.0.0-rc.1",
+		"echo.so.bad", "echo.so.1.4.1.sha256", "echo.sock", "other.so.9.0.0",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path     string
+		expr     string
+		want     string
+		rejected int
+	}{
+		{path: dir, expr: "", want: "echo.so.1.4.1", rejected: 2},
+		{path: dir, expr: "~1.2", want: "echo.so.1.2.0", rejected: 4},
+		{path: dir, expr: ">=2.0.0-rc.1", want: "echo.so.2.0.0-rc.1", rejected: 4},
+		{path: dir, expr: "^3", want: "", rejected: 5},
+		{path: filepath.Join(dir, "echo.so.1.4.1"), expr: "", want: "echo.so.1.4.1"},
+		{path: filepath.Join(dir, "echo.so.1.4.1"), expr: "^1", want: "echo.so.1.4.1"},
+		{path: filepath.Join(dir, "echo.so.1.4.1"), expr: "^2", want: "", rejected: 1},
+		{path: filepath.Join(dir, "echo.so"), expr: "", want: "echo.so"},
+		{path: filepath.Join(dir, "echo.so"), expr: "1.2.0", want: "", rejected: 1},
+		{path: filepath.Join(dir, "missing"), expr: "", want: ""},
+	}
+	for _, tt := range tests {
+		c, err := parseConstraint(tt.expr)
+		if err != nil {
+			t.Fatalf("parseConstraint(%q) failed: %v", tt.expr, err)
+		}
+		got, rejected := findLatestSO("echo", tt.path, c)
+		if filepath.Base(got) != tt.want && !(got == "" && tt.want == "") {
+			t.Errorf("findLatestSO(%s, %q) = %s, want %s", tt.path, tt.expr, got, tt.want)
+		}
+		if len(rejected) != tt.rejected {
+			t.Errorf("findLatestSO(%s, %q) rejected %+v, want %d candidates", tt.path, tt.expr, rejected, tt.rejected)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package elsvc
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultWatchInterval = 10 * time.Second
+
+//watch polls plugin_path of a plugin for a newer version of its binary
+type watch struct {
+	id       string // tells polls of this watch from the ones before
+	interval time.Duration
+	timer    *time.Timer
+	failed   string // binary failed to upgrade to, it's not tried again
+}
+
+//watchInterval returns the validated interval to poll plugin_path, 0 if plugin isn't watched
+func (s PluginConfig) watchInterval() (time.Duration, error) {
+	if !s.Watch {
+		return 0, nil
+	}
+	if isFile(s.PluginPath()) {
+		return 0, fmt.Errorf("plugin_path %s is a file, only dirs could be watched", s.PluginPath())
+	}
+	return parseTimeout("watch_interval", s.WatchInterval, defaultWatchInterval)
+}
+
+//watchPlugin start or stop watching plugin_path of plugin as its config says
+func (s *Service) watchPlugin(pluginName string) {
+	interval, _ := s.pluginConfigs[pluginName].watchInterval()
+	if w, ok := s.watches[pluginName]; ok && w.interval == interval {
+		return
+	}
+	s.unwatch(pluginName)
+	if interval == 0 {
+		return
+	}
+	s.watches[pluginName] = &watch{id: newMsgID(), interval: interval}
+	s.logger.Info("Watching plugin %s in %s every %v", pluginName, s.pluginConfigs[pluginName].PluginPath(), interval)
+	s.watchNext(pluginName)
+}
+
+//watchNext set timer of the next poll of plugin
+func (s *Service) watchNext(pluginName string) {
+	w := s.watches[pluginName]
+	msg := NewMsg(ChanKeyService, MsgWatchPlugin)
+	msg.MsgFrom = ChanKeyService
+	msg.SetRequest(map[string]interface{}{
+		"name":     pluginName,
+		"watch_id": w.id,
+	})
+	svcChan := s.Chans[ChanKeyService]
+	done := s.done
+	w.timer = time.AfterFunc(w.interval, func() {
+		select {
+		case svcChan <- msg:
+		case <-done:
+		}
+	})
+}
+
+func (s *Service) unwatch(pluginName string) {
+	w, ok := s.watches[pluginName]
+	if !ok {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	delete(s.watches, pluginName)
+}
+
+//handleWatchMsg upgrade plugin if a newer version of it is found
+func (s *Service) handleWatchMsg(msg MsgBase) {
+	pluginName, _ := msg.GetRequest()["name"].(string)
+	watchID, _ := msg.GetRequest()["watch_id"].(string)
+	w, ok := s.watches[pluginName]
+	if !ok || w.id != watchID {
+		// plugin is unloaded or its watch changed
+		return
+	}
+	defer s.watchNext(pluginName)
+	if _, ok := s.upgrades[pluginName]; ok {
+		// polled again after the upgrade ends
+		return
+	}
+	pc := s.pluginConfigs[pluginName]
+	// only versions matching version of plugin
+	latest, err := pc.findSO()
+	current := s.states[pluginName].path
+	if err != nil || latest == current || latest == w.failed {
+		return
+	}
+	if !newerVersion(soVersion(latest), soVersion(current)) {
+		return
+	}
+	// plugin not running picks the latest version when it's started again
+	state := s.pluginState(pluginName)
+	if state != StateRunning && state != StateStarting {
+		return
+	}
+	s.logger.Info("Found plugin %s version %s, upgrading from %s", pluginName, soVersion(latest), soVersion(current))
+	// binary failed to upgrade to is marked by endUpgrade
+	err = s.upgradePlugin(pluginName, latest, nil)
+	if err != nil {
+		s.logger.Error("%v", err)
+	}
+}